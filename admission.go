@@ -0,0 +1,148 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// admissionRequests admits the pods on the nodes with enough
+	// unrequested resources.
+	admissionRequests = "requests"
+	// admissionUsage admits the pods on the nodes whose predicted usage
+	// stays under the usage thresholds.
+	admissionUsage = "usage"
+)
+
+func validAdmissionMode(mode string) bool {
+	return mode == admissionRequests || mode == admissionUsage
+}
+
+// admissionMode returns the admission mode of the pod: the mode of its
+// policy, else of its profile, else of the configuration.
+func admissionMode(cfg *Config, pod *Pod) string {
+	if mode := policyFor(pod).admission; mode != "" {
+		return mode
+	}
+	profile := cfg.Profiles[0]
+	for _, p := range cfg.Profiles {
+		if p.SchedulerName == pod.Spec.SchedulerName {
+			profile = p
+		}
+	}
+	if profile.Admission != "" {
+		return profile.Admission
+	}
+	return cfg.Admission.Mode
+}
+
+// estimatedUsage returns the CPU (in millicores) and memory (in bytes) the
+// pod is expected to use: the percentile of the usage history of its
+// workload when known, else its requests.
+func estimatedUsage(pod *Pod) (int64, int64, error) {
+	cfg := currentConfig().UsageHistory
+	if cfg.Enabled {
+		if cpu, memory, ok := usageHistory.estimate(pod, cfg); ok {
+			return cpu, memory, nil
+		}
+	}
+	return podRequests(pod)
+}
+
+// predictedUsage returns the CPU (in millicores) and memory (in bytes) the
+// node is expected to use with the pod: the usage of its metrics, plus the
+// usage assumed for the pods bound since, plus the estimated usage of the
+// pod. The node must have metrics.
+func predictedUsage(cfg *Config, pod *Pod, node *NodeInfo) (int64, int64, error) {
+	usedCPU, err := milliCPU(node.Node.NodeMetrics.Usage.Cpu)
+	if err != nil {
+		return 0, 0, err
+	}
+	usedMemory, err := memoryBytes(node.Node.NodeMetrics.Usage.Memory)
+	if err != nil {
+		return 0, 0, err
+	}
+	pendingCPU, pendingMemory := assumedUsage.pending(node, cfg.Admission.SettleTime.Duration)
+	cpu, memory, err := estimatedUsage(pod)
+	if err != nil {
+		return 0, 0, err
+	}
+	return usedCPU + pendingCPU + cpu, usedMemory + pendingMemory + memory, nil
+}
+
+var assumedUsage = &usageLedger{}
+
+// usageLedger holds the estimated usage of the pods we bound, until the
+// metrics of their node reflect it.
+type usageLedger struct {
+	sync.Mutex
+	byNode map[string][]assumedPod
+}
+
+type assumedPod struct {
+	uid         string
+	cpu, memory int64
+	bound       time.Time
+}
+
+// assume records the estimated usage of the pod, bound to the node at the
+// given time.
+func (l *usageLedger) assume(node string, pod *Pod, bound time.Time) error {
+	cpu, memory, err := estimatedUsage(pod)
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.byNode == nil {
+		l.byNode = map[string][]assumedPod{}
+	}
+	l.byNode[node] = append(l.byNode[node], assumedPod{uid: pod.Metadata.Uid, cpu: cpu, memory: memory, bound: bound})
+	return nil
+}
+
+// pending returns the usage assumed on the node and not reflected by its
+// metrics yet: the pods bound less than settle before the metrics were
+// taken. The pods the metrics reflect are forgotten, as are the pods gone
+// from the node once settled.
+func (l *usageLedger) pending(node *NodeInfo, settle time.Duration) (cpu, memory int64) {
+	// Zero for the nodes without metrics.
+	sampled, _ := time.Parse(time.RFC3339, node.Node.NodeMetrics.Timestamp)
+	onNode := map[string]bool{}
+	for _, p := range node.Pods {
+		onNode[p.Metadata.Uid] = true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	kept := []assumedPod{}
+	for _, p := range l.byNode[node.Name()] {
+		settled := p.bound.Add(settle)
+		if !settled.After(sampled) || (!onNode[p.uid] && time.Now().After(settled)) {
+			continue
+		}
+		kept = append(kept, p)
+		cpu += p.cpu
+		memory += p.memory
+	}
+	if len(kept) == 0 {
+		delete(l.byNode, node.Name())
+	} else {
+		l.byNode[node.Name()] = kept
+	}
+	return cpu, memory
+}
@@ -0,0 +1,886 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer is an in-process Kubernetes API server serving the subset of
+// the API the scheduler uses: nodes and pods with their metrics, the pods
+// watch, bindings, events, leases, Jobs and the storage objects. Objects are kept in memory, in the
+// order they were added, and field selectors on pods are honoured.
+type fakeAPIServer struct {
+	sync.Mutex
+	server *httptest.Server
+
+	nodes   []*Node
+	metrics map[string]NodeMetrics
+	pods    []*Pod
+	// podMetrics are the usage metrics of the pods.
+	podMetrics []PodMetrics
+	events     []*Event
+	bindings   []Binding
+	watchers   map[*fakeWatcher]bool
+	version    int
+
+	volumes ClusterVolumes
+
+	policies       []SchedulingPolicy
+	policyWatchers map[chan SchedulingPolicyWatchEvent]bool
+
+	// jobs are the Jobs, by namespace/name.
+	jobs map[string]*Job
+
+	lease *Lease
+	// partitioned holds the identities whose lease writes are rejected.
+	partitioned map[string]bool
+
+	// unsupportedFields are the pod fields the field selectors ignore, as
+	// older API servers do.
+	unsupportedFields map[string]bool
+	// forbidden are the paths answered with 403 Forbidden.
+	forbidden map[string]bool
+}
+
+type fakeWatcher struct {
+	fieldSelector string
+	events        chan PodWatchEvent
+}
+
+// startFakeAPIServer starts a fake API server, and points the scheduler at
+// it until the end of the test.
+func startFakeAPIServer(t *testing.T) *fakeAPIServer {
+	f := &fakeAPIServer{
+		metrics:           map[string]NodeMetrics{},
+		watchers:          map[*fakeWatcher]bool{},
+		partitioned:       map[string]bool{},
+		unsupportedFields: map[string]bool{},
+		policyWatchers:    map[chan SchedulingPolicyWatchEvent]bool{},
+		jobs:              map[string]*Job{},
+		forbidden:         map[string]bool{},
+	}
+	f.server = httptest.NewServer(f)
+	t.Cleanup(f.server.Close)
+
+	u, _ := url.Parse(f.server.URL)
+	oldHost, oldClient := apiHost, apiClient
+	apiHost, apiClient = u.Host, f.server.Client()
+	t.Cleanup(func() { apiHost, apiClient = oldHost, oldClient })
+	return f
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	path := strings.Join(segments, "/")
+
+	f.Lock()
+	forbidden := f.forbidden[path]
+	f.Unlock()
+	if forbidden {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case path == "api/v1/nodes" && r.Method == http.MethodGet:
+		f.listNodes(w)
+	case path == "api/v1/persistentvolumeclaims" && r.Method == http.MethodGet:
+		f.writeList(w, func() interface{} { return PersistentVolumeClaimList{Items: f.volumes.Claims} })
+	case len(segments) == 6 && segments[4] == "persistentvolumeclaims" && r.Method == http.MethodPatch:
+		f.patchClaim(w, r, segments[3], segments[5])
+	case len(segments) == 4 && segments[2] == "persistentvolumes" && r.Method == http.MethodPatch:
+		f.patchVolume(w, r, segments[3])
+	case path == "api/v1/persistentvolumes" && r.Method == http.MethodGet:
+		f.writeList(w, func() interface{} { return PersistentVolumeList{Items: f.volumes.Volumes} })
+	case path == "apis/storage.k8s.io/v1/storageclasses" && r.Method == http.MethodGet:
+		f.writeList(w, func() interface{} { return StorageClassList{Items: f.volumes.Classes} })
+	case path == "apis/storage.k8s.io/v1/csinodes" && r.Method == http.MethodGet:
+		f.writeList(w, func() interface{} { return CSINodeList{Items: f.volumes.CSINodes} })
+	case path == "apis/scheduling.k8s-resource-scheduler.io/v1alpha1/schedulingpolicies" && r.URL.Query().Get("watch") == "true":
+		f.watchPolicies(w, r)
+	case path == "apis/scheduling.k8s-resource-scheduler.io/v1alpha1/schedulingpolicies" && r.Method == http.MethodGet:
+		f.writeList(w, func() interface{} {
+			list := SchedulingPolicyList{Items: f.policies}
+			list.Metadata.ResourceVersion = strconv.Itoa(f.version)
+			return list
+		})
+	case path == "apis/metrics.k8s.io/v1beta1/pods" && r.Method == http.MethodGet:
+		f.writeList(w, func() interface{} { return PodMetricsList{Items: f.podMetrics} })
+	case strings.HasPrefix(path, "apis/metrics.k8s.io/v1beta1/nodes/") && r.Method == http.MethodGet:
+		f.getNodeMetrics(w, segments[len(segments)-1])
+	case len(segments) == 7 && segments[1] == "batch" && segments[5] == "jobs" && r.Method == http.MethodGet:
+		f.getJob(w, r, segments[4], segments[6])
+	case path == "api/v1/pods" && r.Method == http.MethodGet:
+		f.listPods(w, r.URL.Query().Get("fieldSelector"))
+	case path == "api/v1/watch/pods" && r.Method == http.MethodGet:
+		f.watchPods(w, r)
+	case len(segments) == 7 && segments[4] == "pods" && segments[6] == "binding" && r.Method == http.MethodPost:
+		f.bind(w, r, segments[3], segments[5])
+	case len(segments) == 6 && segments[4] == "pods" && r.Method == http.MethodGet:
+		f.getPod(w, r, segments[3], segments[5])
+	case len(segments) == 6 && segments[4] == "pods" && r.Method == http.MethodPatch:
+		f.patchPod(w, r, segments[3], segments[5])
+	case len(segments) == 7 && segments[4] == "pods" && segments[6] == "status" && r.Method == http.MethodPatch:
+		f.patchPodStatus(w, r, segments[3], segments[5])
+	case len(segments) == 6 && segments[1] == "events.k8s.io" && segments[5] == "events" && r.Method == http.MethodPost:
+		f.createEvent(w, r, segments[4])
+	case len(segments) == 7 && segments[1] == "events.k8s.io" && segments[5] == "events" && r.Method == http.MethodPatch:
+		f.patchEvent(w, r, segments[4], segments[6])
+	case len(segments) >= 6 && segments[0] == "apis" && segments[1] == "coordination.k8s.io" && segments[5] == "leases":
+		f.serveLease(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// addNode adds a ready node with the given allocatable resources, and
+// usage metrics unless cpuUsage is empty.
+func (f *fakeAPIServer) addNode(name, cpu, memory, cpuUsage, memoryUsage string) *Node {
+	f.Lock()
+	defer f.Unlock()
+
+	node := &Node{
+		Metadata: Metadata{Name: name, Labels: map[string]string{"kubernetes.io/hostname": name}},
+		Status: NodeStatus{
+			Allocatable: ResourceList{"cpu": cpu, "memory": memory},
+			Conditions:  []Condition{{Type: "Ready", Status: "True"}},
+		},
+	}
+	f.nodes = append(f.nodes, node)
+	if cpuUsage != "" {
+		f.metrics[name] = NodeMetrics{
+			Metadata:  Metadata{Name: name},
+			Timestamp: time.Now().UTC().Format(time.RFC3339),
+			Usage:     Usage{Cpu: cpuUsage, Memory: memoryUsage},
+		}
+	}
+	return node
+}
+
+// setPodUsage sets the usage metrics of the single container of a pod.
+func (f *fakeAPIServer) setPodUsage(namespace, name, cpu, memory string) {
+	f.Lock()
+	defer f.Unlock()
+	m := PodMetrics{
+		Metadata:   Metadata{Name: name, Namespace: namespace},
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+		Containers: []ContainerMetrics{{Name: "job", Usage: Usage{Cpu: cpu, Memory: memory}}},
+	}
+	for i := range f.podMetrics {
+		if f.podMetrics[i].Metadata.Namespace == namespace && f.podMetrics[i].Metadata.Name == name {
+			f.podMetrics[i] = m
+			return
+		}
+	}
+	f.podMetrics = append(f.podMetrics, m)
+}
+
+// forbid answers the requests to the path with 403 Forbidden.
+func (f *fakeAPIServer) forbid(path string) {
+	f.Lock()
+	defer f.Unlock()
+	f.forbidden[strings.Trim(path, "/")] = true
+}
+
+// addJob adds a Job, controlled by the CronJob when not empty.
+func (f *fakeAPIServer) addJob(namespace, name, cronJob string) {
+	f.Lock()
+	defer f.Unlock()
+	job := &Job{Metadata: Metadata{Name: name, Namespace: namespace}}
+	if cronJob != "" {
+		controller := true
+		job.Metadata.OwnerReferences = []OwnerReference{{ApiVersion: "batch/v1", Kind: "CronJob", Name: cronJob, Controller: &controller}}
+	}
+	f.jobs[namespace+"/"+name] = job
+}
+
+// addVolumes adds storage objects, the API server lists them.
+func (f *fakeAPIServer) addVolumes(v ClusterVolumes) {
+	f.Lock()
+	defer f.Unlock()
+	f.volumes.Claims = append(f.volumes.Claims, v.Claims...)
+	f.volumes.Volumes = append(f.volumes.Volumes, v.Volumes...)
+	f.volumes.Classes = append(f.volumes.Classes, v.Classes...)
+	f.volumes.CSINodes = append(f.volumes.CSINodes, v.CSINodes...)
+}
+
+// claim returns a copy of the persistent volume claim, or nil if it doesn't
+// exist.
+func (f *fakeAPIServer) claim(namespace, name string) *PersistentVolumeClaim {
+	f.Lock()
+	defer f.Unlock()
+	for _, c := range f.volumes.Claims {
+		if c.Metadata.Namespace == namespace && c.Metadata.Name == name {
+			return &c
+		}
+	}
+	return nil
+}
+
+// setPolicy creates or replaces the SchedulingPolicy, notifying the
+// watchers.
+func (f *fakeAPIServer) setPolicy(policy SchedulingPolicy) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.version++
+	policy.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	event := SchedulingPolicyWatchEvent{Type: "ADDED", Object: policy}
+	for i, p := range f.policies {
+		if p.Metadata.Namespace == policy.Metadata.Namespace && p.Metadata.Name == policy.Metadata.Name {
+			f.policies[i] = policy
+			event.Type = "MODIFIED"
+		}
+	}
+	if event.Type == "ADDED" {
+		f.policies = append(f.policies, policy)
+	}
+	for w := range f.policyWatchers {
+		w <- event
+	}
+}
+
+// addPod creates the pod, notifying the watchers.
+func (f *fakeAPIServer) addPod(pod *Pod) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.version++
+	pod.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	if pod.Metadata.Uid == "" {
+		pod.Metadata.Uid = fmt.Sprintf("uid-%d", f.version)
+	}
+	if pod.Status.Phase == "" {
+		pod.Status.Phase = "Pending"
+	}
+	f.pods = append(f.pods, pod)
+	f.notify(nil, pod)
+}
+
+// deletePod deletes the pod, notifying the watchers.
+func (f *fakeAPIServer) deletePod(namespace, name string) {
+	f.Lock()
+	defer f.Unlock()
+
+	for i, p := range f.pods {
+		if p.Metadata.Namespace == namespace && p.Metadata.Name == name {
+			f.pods = append(f.pods[:i], f.pods[i+1:]...)
+			f.notify(p, nil)
+			return
+		}
+	}
+}
+
+// updatePod changes the pod with update, notifying the watchers.
+func (f *fakeAPIServer) updatePod(namespace, name string, update func(pod *Pod)) {
+	f.Lock()
+	defer f.Unlock()
+
+	p := f.findPod(namespace, name)
+	if p == nil {
+		return
+	}
+	old := *p
+	update(p)
+	f.version++
+	p.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.notify(&old, p)
+}
+
+func (f *fakeAPIServer) findPod(namespace, name string) *Pod {
+	for _, p := range f.pods {
+		if p.Metadata.Namespace == namespace && p.Metadata.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// pod returns a copy of the pod, or nil if it doesn't exist.
+func (f *fakeAPIServer) pod(namespace, name string) *Pod {
+	f.Lock()
+	defer f.Unlock()
+	p := f.findPod(namespace, name)
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+// boundNode returns the node the pod was bound to, empty if it wasn't.
+func (f *fakeAPIServer) boundNode(namespace, name string) string {
+	p := f.pod(namespace, name)
+	if p == nil {
+		return ""
+	}
+	return p.Spec.NodeName
+}
+
+// bindingCount returns the number of bindings posted for the pod.
+func (f *fakeAPIServer) bindingCount(namespace, name string) int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, b := range f.bindings {
+		if b.Metadata.Namespace == namespace && b.Metadata.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// eventsFor returns the events posted about the pod with the given reason.
+func (f *fakeAPIServer) eventsFor(name, reason string) []Event {
+	f.Lock()
+	defer f.Unlock()
+	events := []Event{}
+	for _, e := range f.events {
+		if e.Regarding.Name == name && e.Reason == reason {
+			events = append(events, *e)
+		}
+	}
+	return events
+}
+
+// eventCount returns how many times the events about the pod with the given
+// reason occurred, counting their series.
+func (f *fakeAPIServer) eventCount(name, reason string) int {
+	count := 0
+	for _, e := range f.eventsFor(name, reason) {
+		if e.Series != nil {
+			count += int(e.Series.Count)
+		} else {
+			count++
+		}
+	}
+	return count
+}
+
+// notify sends the watch events for a pod changing from old to new, nil
+// when it didn't or doesn't exist anymore. As with the API server, pods
+// entering or leaving the field selector of a watch are ADDED or DELETED.
+func (f *fakeAPIServer) notify(old, new *Pod) {
+	for w := range f.watchers {
+		before := old != nil && f.matchFieldSelector(w.fieldSelector, old)
+		after := new != nil && f.matchFieldSelector(w.fieldSelector, new)
+
+		var event PodWatchEvent
+		switch {
+		case !before && after:
+			event = PodWatchEvent{Type: "ADDED", Object: *new}
+		case before && after:
+			event = PodWatchEvent{Type: "MODIFIED", Object: *new}
+		case before && !after && new != nil:
+			event = PodWatchEvent{Type: "DELETED", Object: *new}
+		case before && !after:
+			event = PodWatchEvent{Type: "DELETED", Object: *old}
+		default:
+			continue
+		}
+
+		select {
+		case w.events <- event:
+		default:
+			// A watcher which can't keep up is dropped, as the API
+			// server does.
+			close(w.events)
+			delete(f.watchers, w)
+		}
+	}
+}
+
+// matchFieldSelector matches the pod against the selector, leaving out the
+// terms on unsupported fields.
+func (f *fakeAPIServer) matchFieldSelector(selector string, pod *Pod) bool {
+	terms := []string{}
+	for _, term := range strings.Split(selector, ",") {
+		field := strings.SplitN(strings.Replace(term, "!=", "=", 1), "=", 2)[0]
+		if term != "" && !f.unsupportedFields[field] {
+			terms = append(terms, term)
+		}
+	}
+	return matchFieldSelector(strings.Join(terms, ","), pod)
+}
+
+// matchFieldSelector tells whether the pod matches the selector, made of
+// comma separated field=value or field!=value terms.
+func matchFieldSelector(selector string, pod *Pod) bool {
+	if selector == "" {
+		return true
+	}
+
+	fields := map[string]string{
+		"metadata.name":      pod.Metadata.Name,
+		"metadata.namespace": pod.Metadata.Namespace,
+		"spec.nodeName":      pod.Spec.NodeName,
+		"spec.schedulerName": pod.Spec.SchedulerName,
+		"status.phase":       pod.Status.Phase,
+	}
+	for _, term := range strings.Split(selector, ",") {
+		if i := strings.Index(term, "!="); i != -1 {
+			if fields[term[:i]] == term[i+2:] {
+				return false
+			}
+			continue
+		}
+		i := strings.Index(term, "=")
+		if i == -1 {
+			return false
+		}
+		if fields[term[:i]] != strings.TrimPrefix(term[i+1:], "=") {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fakeAPIServer) listNodes(w http.ResponseWriter) {
+	f.Lock()
+	defer f.Unlock()
+	json.NewEncoder(w).Encode(NodeList{ApiVersion: "v1", Kind: "NodeList", Items: f.nodes})
+}
+
+func (f *fakeAPIServer) getNodeMetrics(w http.ResponseWriter, name string) {
+	f.Lock()
+	defer f.Unlock()
+	m, ok := f.metrics[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(m)
+}
+
+func (f *fakeAPIServer) listPods(w http.ResponseWriter, fieldSelector string) {
+	f.Lock()
+	defer f.Unlock()
+	list := PodList{ApiVersion: "v1", Kind: "PodList", Items: []Pod{}}
+	list.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	for _, p := range f.pods {
+		if f.matchFieldSelector(fieldSelector, p) {
+			list.Items = append(list.Items, *p)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// watchPods streams the matching pods as ADDED events, then their changes
+// until the client goes away.
+func (f *fakeAPIServer) watchPods(w http.ResponseWriter, r *http.Request) {
+	watcher := &fakeWatcher{fieldSelector: r.URL.Query().Get("fieldSelector"), events: make(chan PodWatchEvent, 100)}
+
+	f.Lock()
+	initial := []PodWatchEvent{}
+	for _, p := range f.pods {
+		if f.matchFieldSelector(watcher.fieldSelector, p) {
+			initial = append(initial, PodWatchEvent{Type: "ADDED", Object: *p})
+		}
+	}
+	f.watchers[watcher] = true
+	f.Unlock()
+
+	defer func() {
+		f.Lock()
+		delete(f.watchers, watcher)
+		f.Unlock()
+	}()
+
+	enc := json.NewEncoder(w)
+	flusher := w.(http.Flusher)
+	w.WriteHeader(http.StatusOK)
+	for _, e := range initial {
+		enc.Encode(e)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e, ok := <-watcher.events:
+			if !ok {
+				return
+			}
+			enc.Encode(e)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// watchPolicies streams the changes of the SchedulingPolicies, from the
+// version listed: no initial events are sent.
+func (f *fakeAPIServer) watchPolicies(w http.ResponseWriter, r *http.Request) {
+	events := make(chan SchedulingPolicyWatchEvent, 100)
+	f.Lock()
+	f.policyWatchers[events] = true
+	f.Unlock()
+	defer func() {
+		f.Lock()
+		delete(f.policyWatchers, events)
+		f.Unlock()
+	}()
+
+	enc := json.NewEncoder(w)
+	flusher := w.(http.Flusher)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case e := <-events:
+			enc.Encode(e)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeAPIServer) bind(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	binding := Binding{}
+	err := json.NewDecoder(r.Body).Decode(&binding)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.bindings = append(f.bindings, binding)
+
+	p := f.findPod(namespace, name)
+	if p == nil {
+		http.Error(w, fmt.Sprintf(`pods "%s" not found`, name), http.StatusNotFound)
+		return
+	}
+	if p.Spec.NodeName != "" {
+		http.Error(w, fmt.Sprintf(`pod %s is already assigned to node %q`, name, p.Spec.NodeName), http.StatusConflict)
+		return
+	}
+
+	old := *p
+	p.Spec.NodeName = binding.Target.Name
+	f.version++
+	p.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.notify(&old, p)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(binding)
+}
+
+func (f *fakeAPIServer) patchPod(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	patch := Pod{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	p := f.findPod(namespace, name)
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	old := *p
+	if len(patch.Metadata.Annotations) != 0 {
+		annotations := map[string]string{}
+		for k, v := range p.Metadata.Annotations {
+			annotations[k] = v
+		}
+		for k, v := range patch.Metadata.Annotations {
+			annotations[k] = v
+		}
+		p.Metadata.Annotations = annotations
+	}
+	f.version++
+	p.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.notify(&old, p)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (f *fakeAPIServer) getPod(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	f.Lock()
+	defer f.Unlock()
+	p := f.findPod(namespace, name)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(p)
+}
+
+func (f *fakeAPIServer) getJob(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	f.Lock()
+	defer f.Unlock()
+	job, ok := f.jobs[namespace+"/"+name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(job)
+}
+
+// writeList encodes the list of objects returned by list.
+func (f *fakeAPIServer) writeList(w http.ResponseWriter, list func() interface{}) {
+	f.Lock()
+	defer f.Unlock()
+	json.NewEncoder(w).Encode(list())
+}
+
+// patchClaim merges the annotations of the patch into the claim.
+func (f *fakeAPIServer) patchClaim(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	patch := PersistentVolumeClaim{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for i := range f.volumes.Claims {
+		c := &f.volumes.Claims[i]
+		if c.Metadata.Namespace != namespace || c.Metadata.Name != name {
+			continue
+		}
+		annotations := map[string]string{}
+		for k, v := range c.Metadata.Annotations {
+			annotations[k] = v
+		}
+		for k, v := range patch.Metadata.Annotations {
+			annotations[k] = v
+		}
+		c.Metadata.Annotations = annotations
+		json.NewEncoder(w).Encode(c)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// patchVolume sets the claimRef of the volume, if its resourceVersion is
+// unchanged, and binds the claim to it as the PV controller would.
+func (f *fakeAPIServer) patchVolume(w http.ResponseWriter, r *http.Request, name string) {
+	patch := PersistentVolume{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil || patch.Spec.ClaimRef == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for i := range f.volumes.Volumes {
+		pv := &f.volumes.Volumes[i]
+		if pv.Metadata.Name != name {
+			continue
+		}
+		if patch.Metadata.ResourceVersion != pv.Metadata.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		ref := *patch.Spec.ClaimRef
+		pv.Spec.ClaimRef = &ref
+		pv.Status.Phase = "Bound"
+		f.version++
+		pv.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		for j := range f.volumes.Claims {
+			c := &f.volumes.Claims[j]
+			if c.Metadata.Namespace == ref.Namespace && c.Metadata.Name == ref.Name {
+				c.Spec.VolumeName = name
+				c.Status.Phase = "Bound"
+			}
+		}
+		json.NewEncoder(w).Encode(pv)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// patchPodStatus applies a strategic merge patch of the pod conditions,
+// merged by type.
+func (f *fakeAPIServer) patchPodStatus(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	if r.Header.Get("Content-Type") != "application/strategic-merge-patch+json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	patch := Pod{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	p := f.findPod(namespace, name)
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	old := *p
+	conditions := append([]PodCondition{}, p.Status.Conditions...)
+PATCH:
+	for _, c := range patch.Status.Conditions {
+		for i := range conditions {
+			if conditions[i].Type == c.Type {
+				conditions[i] = c
+				continue PATCH
+			}
+		}
+		conditions = append(conditions, c)
+	}
+	p.Status.Conditions = conditions
+	f.version++
+	p.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.notify(&old, p)
+	json.NewEncoder(w).Encode(p)
+}
+
+// podScheduled returns the PodScheduled condition of the pod.
+func (f *fakeAPIServer) podScheduled(namespace, name string) PodCondition {
+	for _, c := range f.pod(namespace, name).Status.Conditions {
+		if c.Type == "PodScheduled" {
+			return c
+		}
+	}
+	return PodCondition{}
+}
+
+// createEvent stores the event, after the validation of the API server.
+func (f *fakeAPIServer) createEvent(w http.ResponseWriter, r *http.Request, namespace string) {
+	event := &Event{}
+	err := json.NewDecoder(r.Body).Decode(event)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if event.Metadata.Namespace != namespace || event.Regarding.Namespace != namespace || event.EventTime == "" ||
+		event.ReportingController == "" || event.ReportingInstance == "" || event.Action == "" || event.Reason == "" ||
+		len(event.Note) > 1024 || (event.Type != "Normal" && event.Type != "Warning") {
+		http.Error(w, "invalid event", http.StatusUnprocessableEntity)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.events = append(f.events, event)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(event)
+}
+
+func (f *fakeAPIServer) patchEvent(w http.ResponseWriter, r *http.Request, namespace, name string) {
+	patch := Event{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for _, e := range f.events {
+		if e.Metadata.Namespace == namespace && e.Metadata.Name == name {
+			e.Series = patch.Series
+			json.NewEncoder(w).Encode(e)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// serveLease serves a single Lease with optimistic concurrency, like the
+// API server does.
+func (f *fakeAPIServer) serveLease(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case http.MethodPost, http.MethodPut:
+		lease := &Lease{}
+		if err := json.NewDecoder(r.Body).Decode(lease); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if f.partitioned[lease.Spec.HolderIdentity] {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == http.MethodPost && f.lease != nil {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		if r.Method == http.MethodPut && (f.lease == nil || f.lease.Metadata.ResourceVersion != lease.Metadata.ResourceVersion) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+
+		f.version++
+		lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.lease = lease
+
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeAPIServer) leaseHolder() string {
+	f.Lock()
+	defer f.Unlock()
+	if f.lease == nil {
+		return ""
+	}
+	return f.lease.Spec.HolderIdentity
+}
+
+func (f *fakeAPIServer) partition(identity string) {
+	f.Lock()
+	defer f.Unlock()
+	f.partitioned[identity] = true
+}
+
+// eventually fails the test if condition isn't true within timeout.
+func eventually(t *testing.T, timeout time.Duration, condition func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
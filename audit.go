@@ -0,0 +1,329 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the durable record of a scheduling attempt: the pod, the
+// state of the nodes it was scheduled against, the decision and its outcome.
+type AuditRecord struct {
+	Time     string      `json:"time"`
+	Pod      AuditPod    `json:"pod"`
+	Nodes    []AuditNode `json:"nodes"`
+	Decision Decision    `json:"decision"`
+	// Outcome is scheduled, unschedulable, dropped or error.
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+type AuditPod struct {
+	Namespace     string    `json:"namespace"`
+	Name          string    `json:"name"`
+	Uid           string    `json:"uid"`
+	SchedulerName string    `json:"schedulerName"`
+	Requests      Resources `json:"requests"`
+}
+
+// AuditNode is the state of a node when the pod was scheduled.
+type AuditNode struct {
+	Name        string    `json:"name"`
+	Allocatable Resources `json:"allocatable"`
+	Requested   Resources `json:"requested"`
+	Usage       Resources `json:"usage"`
+	Pods        int       `json:"pods"`
+}
+
+// Resources is an amount of CPU, in millicores, and memory, in bytes.
+type Resources struct {
+	CPU    int64 `json:"cpu"`
+	Memory int64 `json:"memory"`
+}
+
+func newAuditRecord(pod *Pod, d Decision, fr *fitResult, outcome string, err error) *AuditRecord {
+	record := &AuditRecord{
+		Time: time.Now().UTC().Format(time.RFC3339Nano),
+		Pod: AuditPod{
+			Namespace:     pod.Metadata.Namespace,
+			Name:          pod.Metadata.Name,
+			Uid:           pod.Metadata.Uid,
+			SchedulerName: pod.Spec.SchedulerName,
+		},
+		Nodes:    make([]AuditNode, 0, len(fr.nodes)),
+		Decision: d,
+		Outcome:  outcome,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	// The requests were already parsed successfully by the filters, and
+	// invalid metrics are recorded as 0.
+	record.Pod.Requests.CPU, record.Pod.Requests.Memory, _ = podRequests(pod)
+	for _, n := range fr.nodes {
+		node := AuditNode{
+			Name:      n.Name(),
+			Requested: Resources{CPU: n.RequestedCPU, Memory: n.RequestedMemory},
+			Pods:      len(n.Pods),
+		}
+		node.Allocatable.CPU, _ = milliCPU(n.Node.Status.Allocatable["cpu"])
+		node.Allocatable.Memory, _ = memoryBytes(n.Node.Status.Allocatable["memory"])
+		node.Usage.CPU, _ = milliCPU(n.Node.NodeMetrics.Usage.Cpu)
+		node.Usage.Memory, _ = memoryBytes(n.Node.NodeMetrics.Usage.Memory)
+		record.Nodes = append(record.Nodes, node)
+	}
+	return record
+}
+
+// AuditSink stores the audit records.
+type AuditSink interface {
+	Write(record *AuditRecord) error
+	Close() error
+}
+
+// auditSinks are the sinks configured, written to in order.
+var auditSinks []AuditSink
+
+// newAuditSinks returns the sinks enabled in the configuration.
+func newAuditSinks(cfg AuditConfig) ([]AuditSink, error) {
+	sinks := []AuditSink{}
+	if cfg.File.Path != "" {
+		s, err := newFileAuditSink(cfg.File.Path, int64(cfg.File.MaxSizeMB)<<20, cfg.File.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.Webhook.URL != "" {
+		sinks = append(sinks, newWebhookAuditSink(cfg.Webhook.URL, cfg.Webhook.Timeout.Duration))
+	}
+	return sinks, nil
+}
+
+// audit writes the record to all the sinks. Failures are only logged.
+func audit(log *Logger, record *AuditRecord) {
+	for _, s := range auditSinks {
+		err := s.Write(record)
+		if err != nil {
+			log.Warn("Failed writing audit record", "err", err)
+		}
+	}
+}
+
+func closeAuditSinks() {
+	for _, s := range auditSinks {
+		err := s.Close()
+		if err != nil {
+			logger.Warn("Failed closing audit sink", "err", err)
+		}
+	}
+}
+
+// fileAuditSink writes the records as JSON lines to a file, rotated when it
+// grows over maxSize bytes. The rotated files are suffixed with .1 (the most
+// recent) to .maxBackups, older ones are removed.
+type fileAuditSink struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func newFileAuditSink(path string, maxSize int64, maxBackups int) (*fileAuditSink, error) {
+	s := &fileAuditSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileAuditSink) Write(record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.f == nil {
+		return errors.New("audit file closed")
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.maxSize {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileAuditSink) rotate() error {
+	err := s.f.Close()
+	s.f = nil
+	if err != nil {
+		return err
+	}
+
+	if s.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", s.path, s.maxBackups))
+		for i := s.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		err = os.Rename(s.path, s.path+".1")
+	} else {
+		err = os.Remove(s.path)
+	}
+	if err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *fileAuditSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// webhookAuditSink posts each record as JSON to a URL. Records are sent in
+// the background, so a slow webhook doesn't hold the scheduling loop, and
+// dropped when too many are waiting.
+type webhookAuditSink struct {
+	url     string
+	client  *http.Client
+	records chan *AuditRecord
+	done    chan struct{}
+	// stop is closed when the records still queued on Close can't be sent
+	// within drainTimeout.
+	stop         chan struct{}
+	drainTimeout time.Duration
+}
+
+const (
+	webhookAuditQueueSize    = 1000
+	webhookAuditDrainTimeout = 10 * time.Second
+)
+
+func newWebhookAuditSink(url string, timeout time.Duration) *webhookAuditSink {
+	s := &webhookAuditSink{
+		url:          url,
+		client:       &http.Client{Timeout: timeout},
+		records:      make(chan *AuditRecord, webhookAuditQueueSize),
+		done:         make(chan struct{}),
+		stop:         make(chan struct{}),
+		drainTimeout: webhookAuditDrainTimeout,
+	}
+	go s.run()
+	return s
+}
+
+func (s *webhookAuditSink) Write(record *AuditRecord) error {
+	select {
+	case s.records <- record:
+		return nil
+	default:
+		return errors.New("audit webhook queue full, dropping record")
+	}
+}
+
+func (s *webhookAuditSink) run() {
+	defer close(s.done)
+	for record := range s.records {
+		select {
+		case <-s.stop:
+			dropped := 1
+			for range s.records {
+				dropped++
+			}
+			logger.Warn("Audit webhook too slow on shutdown, records dropped", "url", s.url, "dropped", dropped)
+			return
+		default:
+		}
+
+		err := s.post(record)
+		if err != nil {
+			logger.Warn("Failed posting audit record", "url", s.url, "pod", record.Pod.Name, "err", err)
+		}
+	}
+}
+
+func (s *webhookAuditSink) post(record *AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("Audit webhook: Unexpected HTTP status code" + resp.Status + string(b))
+	}
+	return nil
+}
+
+// Close sends the records still queued, and stops the sink. The records
+// not sent within drainTimeout are dropped, the record being sent is given
+// the client timeout.
+func (s *webhookAuditSink) Close() error {
+	close(s.records)
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(s.drainTimeout):
+	}
+	close(s.stop)
+	<-s.done
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testAuditRecord(name string) *AuditRecord {
+	pod := &Pod{
+		Metadata: Metadata{Name: name, Namespace: "default", Uid: name + "-uid"},
+		Spec: PodSpec{
+			SchedulerName: schedulerName,
+			Containers: []Container{
+				{Resources: ResourceRequirements{Requests: ResourceList{"cpu": "500m", "memory": "1Gi"}}},
+			},
+		},
+	}
+	node := &Node{
+		Metadata: Metadata{Name: "worker-1"},
+		Status:   NodeStatus{Allocatable: ResourceList{"cpu": "4", "memory": "8Gi"}},
+	}
+	fr := &fitResult{
+		nodes:    []*NodeInfo{{Node: node, RequestedCPU: 1000}},
+		feasible: []*NodeInfo{{Node: node, RequestedCPU: 1000}},
+		failures: map[string]string{},
+	}
+	scores := []NodeScore{{Node: "worker-1", Score: 75, Plugins: map[string]int64{"LeastUsage": 75}}}
+
+	return newAuditRecord(pod, newDecision(schedulerName, fr, scores, "worker-1"), fr, "scheduled", nil)
+}
+
+func readAuditRecords(t *testing.T, path string) []AuditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	records := []AuditRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r AuditRecord
+		err := json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			t.Fatalf("invalid audit line %q: %s", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestFileAuditSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := newFileAuditSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err := s.Write(testAuditRecord(fmt.Sprintf("pod-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := readAuditRecords(t, path)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+	r := records[0]
+	if r.Pod.Name != "pod-0" || r.Pod.Requests != (Resources{CPU: 500, Memory: 1 << 30}) {
+		t.Errorf("unexpected pod %+v", r.Pod)
+	}
+	if len(r.Nodes) != 1 || r.Nodes[0].Allocatable != (Resources{CPU: 4000, Memory: 8 << 30}) || r.Nodes[0].Requested.CPU != 1000 {
+		t.Errorf("unexpected nodes %+v", r.Nodes)
+	}
+	if r.Outcome != "scheduled" || r.Decision.Selected != "worker-1" || r.Decision.Ranking[0].Plugins["LeastUsage"] != 75 {
+		t.Errorf("unexpected outcome %q, decision %+v", r.Outcome, r.Decision)
+	}
+
+	// Records are appended to the existing file.
+	s, err = newFileAuditSink(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write(testAuditRecord("pod-3"))
+	s.Close()
+	if n := len(readAuditRecords(t, path)); n != 4 {
+		t.Errorf("expected 4 records after reopening, got %d", n)
+	}
+}
+
+func TestFileAuditSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	b, _ := json.Marshal(testAuditRecord("pod-0"))
+	lineSize := int64(len(b) + 1)
+
+	// Two records per file, with some slack as the timestamps vary in
+	// length, and two backups.
+	s, err := newFileAuditSink(path, 2*lineSize+lineSize/2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		err := s.Write(testAuditRecord(fmt.Sprintf("pod-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	expected := map[string][]string{
+		path:        {"pod-6"},
+		path + ".1": {"pod-4", "pod-5"},
+		path + ".2": {"pod-2", "pod-3"},
+	}
+	for file, pods := range expected {
+		records := readAuditRecords(t, file)
+		if len(records) != len(pods) {
+			t.Errorf("%s: expected %d records, got %d", file, len(pods), len(records))
+			continue
+		}
+		for i, r := range records {
+			if r.Pod.Name != pods[i] {
+				t.Errorf("%s: expected %s at line %d, got %s", file, pods[i], i, r.Pod.Name)
+			}
+		}
+	}
+
+	_, err = os.Stat(path + ".3")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the oldest audit log to be removed, got %v", err)
+	}
+
+	err = s.Write(testAuditRecord("pod-7"))
+	if err == nil {
+		t.Error("expected writing to a closed sink to fail")
+	}
+}
+
+func TestWebhookAuditSinkCloseDeadline(t *testing.T) {
+	var lock sync.Mutex
+	posted := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		lock.Lock()
+		posted++
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	s := newWebhookAuditSink(server.URL, time.Second)
+	s.drainTimeout = 250 * time.Millisecond
+	for i := 0; i < 20; i++ {
+		err := s.Write(testAuditRecord(fmt.Sprintf("pod-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	s.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected Close to give up on the queued records, it took %s", elapsed)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if posted == 0 || posted == 20 {
+		t.Errorf("expected some of the records to be sent before the deadline, %d were", posted)
+	}
+}
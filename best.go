@@ -16,29 +16,9 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"strconv"
 	"strings"
 )
 
-func cpuUnits(s string) (int, error) {
-	strip := strings.ReplaceAll(s, "n", "")
-	usage, err := strconv.Atoi(strip)
-	if err != nil {
-		return 0, err
-	}
-	return usage, nil
-}
-
-func memoryUnits(s string) (int, error) {
-	strip := strings.ReplaceAll(s, "Ki", "")
-	usage, err := strconv.Atoi(strip)
-	if err != nil {
-		return 0, err
-	}
-	return usage, nil
-}
-
 func getPropertyBool(property string, m Metadata) bool {
 	prop := getProperty(property, m)
 	if prop == "" {
@@ -63,84 +43,36 @@ func getProperty(property string, m Metadata) string {
 	return prop
 }
 
-func bestNode(pod *Pod, nodes []Node) (*Node, error) {
-	var bestNode *Node
-
-	podCPUBound := getPropertyBool("cpu-bound", pod.Metadata)
-	if podCPUBound {
-		log.Println("Pod", pod.Metadata.Name, "is cpu bound")
-	}
+// bestNode returns the node with the highest score given by the enabled
+// score plugins, and the scores of all the nodes. Ties go to the first node.
+func bestNode(log *Logger, pod *Pod, nodes []*NodeInfo) (*NodeInfo, []NodeScore, error) {
+	var bestNode *NodeInfo
+	var bestScore int64
 
-	podMemoryBound := getPropertyBool("memory-bound", pod.Metadata)
-	if podMemoryBound {
-		log.Println("Pod", pod.Metadata.Name, "is memory bound")
+	scores, err := frameworkFor(pod).score(log, pod, nodes)
+	if err != nil {
+		return nil, nil, err
 	}
 
-NODES:
-	for i := range nodes {
-		currentNode := &nodes[i]
-
-		for l, v := range pod.Spec.NodeSelector {
-			if currentNode.Metadata.Labels[l] != v {
-				log.Println("Node", currentNode.Metadata.Name, "does not match selector", currentNode.Metadata.Labels)
-				continue NODES
-			}
-		}
-
-		nodeCPUBound := getPropertyBool("cpu-bound", currentNode.Metadata)
-		if nodeCPUBound {
-			log.Println("Node", currentNode.Metadata.Name, "is cpu bound")
-		}
-		nodeMemoryBound := getPropertyBool("memory-bound", currentNode.Metadata)
-		if nodeMemoryBound {
-			log.Println("Node", currentNode.Metadata.Name, "is memory bound")
-		}
-
+	for i, currentNode := range nodes {
 		if bestNode == nil {
-			bestNode = currentNode
-			continue
-		}
-		log.Println(fmt.Sprintf("Current best CPU %s Memory %s (%s)", bestNode.NodeMetrics.Usage.Cpu, bestNode.NodeMetrics.Usage.Memory, bestNode.Metadata.Name))
-
-		bestNodeCPUUsage, err := cpuUnits(bestNode.NodeMetrics.Usage.Cpu)
-		if err != nil {
-			log.Println(err.Error())
-			continue
-		}
-
-		bestNodeMemoryUsage, err := memoryUnits(bestNode.NodeMetrics.Usage.Memory)
-		if err != nil {
-			log.Println(err.Error())
+			bestNode, bestScore = currentNode, scores[i].Score
 			continue
 		}
 
-		currentNodeCPUUsage, err := cpuUnits(currentNode.NodeMetrics.Usage.Cpu)
-		if err != nil {
-			log.Println(err.Error())
-			continue
+		// Logged for every node, the fields are only built when debugging.
+		if log.enabled(levelDebug) {
+			log.Debug("Comparing nodes",
+				"best", bestNode.Name(), "bestScore", bestScore,
+				"bestCPU", bestNode.Node.NodeMetrics.Usage.Cpu, "bestMemory", bestNode.Node.NodeMetrics.Usage.Memory,
+				"candidate", currentNode.Name(), "candidateScore", scores[i].Score,
+				"candidateCPU", currentNode.Node.NodeMetrics.Usage.Cpu, "candidateMemory", currentNode.Node.NodeMetrics.Usage.Memory,
+				"switch", scores[i].Score > bestScore)
 		}
-
-		currentNodeMemoryUsage, err := memoryUnits(currentNode.NodeMetrics.Usage.Memory)
-		if err != nil {
-			log.Println(err.Error())
-			continue
-		}
-
-		if (((podCPUBound || nodeCPUBound) && (!podMemoryBound || !nodeMemoryBound)) && (currentNodeCPUUsage < bestNodeCPUUsage)) || // CPU bound
-			(((podMemoryBound || nodeMemoryBound) && (!podCPUBound || !nodeCPUBound)) && (currentNodeMemoryUsage < bestNodeMemoryUsage)) || // Memory bound
-			(currentNodeMemoryUsage < bestNodeMemoryUsage && currentNodeCPUUsage < bestNodeCPUUsage) { // Otherwise
-			log.Println(
-				fmt.Sprintf("switch: %s (cpu %s mem %s) has a lower resource usage than %s (cpu %s mem %s)",
-					currentNode.Metadata.Name, currentNode.NodeMetrics.Usage.Cpu, currentNode.NodeMetrics.Usage.Memory,
-					bestNode.Metadata.Name, bestNode.NodeMetrics.Usage.Cpu, bestNode.NodeMetrics.Usage.Memory))
-			bestNode = currentNode
-		} else {
-			log.Println(
-				fmt.Sprintf("%s (cpu %s mem %s) has a lower resource usage than %s (cpu %s mem %s)",
-					bestNode.Metadata.Name, bestNode.NodeMetrics.Usage.Cpu, bestNode.NodeMetrics.Usage.Memory,
-					currentNode.Metadata.Name, currentNode.NodeMetrics.Usage.Cpu, currentNode.NodeMetrics.Usage.Memory))
+		if scores[i].Score > bestScore {
+			bestNode, bestScore = currentNode, scores[i].Score
 		}
 	}
 
-	return bestNode, nil
+	return bestNode, scores, nil
 }
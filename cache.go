@@ -0,0 +1,134 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var cache = &schedulerCache{}
+
+// schedulerCache holds the last cluster state observed by this replica.
+// Standby replicas keep it warm, so that they can start scheduling as soon
+// as they acquire leadership.
+type schedulerCache struct {
+	sync.RWMutex
+	nodes    *NodeList
+	pods     *PodList
+	volumes  *VolumeState
+	lastSync time.Time
+}
+
+func (c *schedulerCache) refresh() error {
+	nodes, err := getNodes()
+	if err != nil {
+		return err
+	}
+
+	pods, err := getPods()
+	if err != nil {
+		return err
+	}
+
+	volumes, err := getVolumes()
+	if err != nil {
+		// Only the pods with claims need them, the others are still
+		// scheduled.
+		logger.Warn("Failed listing the storage objects, the pods with claims can't be scheduled", "err", err)
+		volumes = &ClusterVolumes{}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.nodes = nodes
+	c.pods = pods
+	c.volumes = newVolumeState(volumes)
+	c.lastSync = time.Now()
+	return nil
+}
+
+func (c *schedulerCache) snapshot() (*NodeList, *PodList, *VolumeState, error) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.nodes == nil || c.pods == nil {
+		return nil, nil, nil, errors.New("cluster state not synced yet")
+	}
+	return c.nodes, c.pods, c.volumes, nil
+}
+
+// stale tells whether the cluster state was last refreshed more than maxAge
+// ago, or never.
+func (c *schedulerCache) stale(maxAge time.Duration) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return time.Since(c.lastSync) > maxAge
+}
+
+// assume records the pod as bound to the node in the cached pods, until the
+// next refresh lists it, so that the next attempts account for it.
+func (c *schedulerCache) assume(pod *Pod, node string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.pods == nil {
+		return
+	}
+
+	bound := *pod
+	bound.Spec.NodeName = node
+	pods := *c.pods
+	pods.Items = make([]Pod, 0, len(c.pods.Items)+1)
+	for _, p := range c.pods.Items {
+		if p.Metadata.Namespace != pod.Metadata.Namespace || p.Metadata.Name != pod.Metadata.Name {
+			pods.Items = append(pods.Items, p)
+		}
+	}
+	pods.Items = append(pods.Items, bound)
+	c.pods = &pods
+}
+
+// reserveVolumes records the volumes as reserved for their claim in the
+// cached storage objects, until the next refresh lists them so.
+func (c *schedulerCache) reserveVolumes(matched map[*PersistentVolumeClaim]*PersistentVolume) {
+	c.Lock()
+	defer c.Unlock()
+	if c.volumes == nil || len(matched) == 0 {
+		return
+	}
+	c.volumes = c.volumes.reserve(matched)
+}
+
+func (c *schedulerCache) synced() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return !c.lastSync.IsZero()
+}
+
+func (c *schedulerCache) run(interval time.Duration, done chan struct{}, wg *sync.WaitGroup) {
+	for {
+		err := c.refresh()
+		if err != nil {
+			logger.Warn("Failed refreshing cluster state", "err", err)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-done:
+			wg.Done()
+			logger.Info("Stopped cache refresh")
+			return
+		}
+	}
+}
@@ -0,0 +1,893 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	configAPIVersion = "k8s-resource-scheduler/v1alpha1"
+	configKind       = "SchedulerConfiguration"
+)
+
+// Config is the scheduler configuration, loaded from a versioned YAML file
+// and overridden by command line flags.
+type Config struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+
+	API APIConfig `yaml:"api"`
+
+	// BindAddress is the address the /metrics, /healthz and /readyz
+	// endpoints are served on, empty to disable them.
+	BindAddress string `yaml:"bindAddress"`
+
+	Health HealthConfig `yaml:"health"`
+
+	Logging LoggingConfig `yaml:"logging"`
+
+	// Profiles are the scheduling profiles served, each selected by the
+	// pods with its spec.schedulerName.
+	Profiles []ProfileConfig `yaml:"profiles"`
+
+	// Shadow only computes where the pods would be placed, and compares
+	// it with where they actually got bound, without binding anything.
+	Shadow bool `yaml:"shadow"`
+
+	Workers              int      `yaml:"workers"`
+	QueueSize            int      `yaml:"queueSize"`
+	ReconcileInterval    Duration `yaml:"reconcileInterval"`
+	CacheRefreshInterval Duration `yaml:"cacheRefreshInterval"`
+
+	// MaxParallelJobs is the number of running pods per node the
+	// MaxParallelJobs filter allows. 0 disables the limit.
+	MaxParallelJobs int `yaml:"maxParallelJobs"`
+
+	// Plugins are the plugins of the profiles which don't set their own.
+	Plugins PluginsConfig `yaml:"plugins"`
+
+	// NodePools group the nodes by label, each with its own scoring,
+	// overcommit and concurrency limit.
+	NodePools []NodePoolConfig `yaml:"nodePools"`
+
+	Admission AdmissionConfig `yaml:"admission"`
+
+	UsageHistory UsageHistoryConfig `yaml:"usageHistory"`
+
+	Decisions DecisionsConfig `yaml:"decisions"`
+
+	Audit AuditConfig `yaml:"audit"`
+
+	Extender ExtenderConfig `yaml:"extender"`
+
+	Policies PoliciesConfig `yaml:"policies"`
+
+	LeaderElection LeaderElectionConfig `yaml:"leaderElection"`
+
+	Reload ReloadConfig `yaml:"reload"`
+
+	// file is the configuration file given with --config.
+	file string
+}
+
+type APIConfig struct {
+	// Host is the address of the API server, usually a kubectl proxy.
+	Host string `yaml:"host"`
+	// NodeMetricsPath is the path of the node metrics, %s is the node name.
+	NodeMetricsPath string `yaml:"nodeMetricsPath"`
+	// PodMetricsPath is the path of the metrics of all the pods.
+	PodMetricsPath string `yaml:"podMetricsPath"`
+}
+
+type ProfileConfig struct {
+	SchedulerName string `yaml:"schedulerName"`
+	// Plugins overrides the default filter and/or score plugins.
+	Plugins PluginsConfig `yaml:"plugins,omitempty"`
+	// Admission overrides the admission mode of the configuration.
+	Admission string `yaml:"admission,omitempty"`
+}
+
+type PluginsConfig struct {
+	Filter []PluginConfig `yaml:"filter,omitempty"`
+	Score  []PluginConfig `yaml:"score,omitempty"`
+}
+
+// PluginConfig enables a plugin. Weight only applies to score plugins, and
+// defaults to 1.
+type PluginConfig struct {
+	Name   string `yaml:"name"`
+	Weight int64  `yaml:"weight,omitempty"`
+}
+
+// AdmissionConfig configures how the NodeResourcesFit filter admits pods on
+// the nodes.
+type AdmissionConfig struct {
+	// Mode is requests, to admit the pods on their requests, or usage, to
+	// admit them on the predicted usage of the nodes.
+	Mode string `yaml:"mode"`
+	// CPUThreshold and MemoryThreshold are the shares of the allocatable
+	// resources the predicted usage must stay under, in usage mode.
+	CPUThreshold    float64 `yaml:"cpuThreshold"`
+	MemoryThreshold float64 `yaml:"memoryThreshold"`
+	// MaxOvercommitRatio caps the requests of the pods of a node at this
+	// ratio of its allocatable resources, in usage mode.
+	MaxOvercommitRatio float64 `yaml:"maxOvercommitRatio"`
+	// SettleTime is how long after a pod is bound its usage is assumed,
+	// until the node metrics reflect it.
+	SettleTime Duration `yaml:"settleTime"`
+}
+
+// UsageHistoryConfig configures the learning of the usage of the workloads
+// from the metrics of their pods.
+type UsageHistoryConfig struct {
+	// Enabled collects the pod metrics, and estimates the usage of the pods
+	// of the known workloads from them instead of their requests.
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often the pod metrics are collected.
+	Interval Duration `yaml:"interval"`
+	// Percentile of the usage samples of a workload its pods are expected
+	// to use.
+	Percentile float64 `yaml:"percentile"`
+	// MinSamples is the number of samples a workload needs to be known.
+	MinSamples int `yaml:"minSamples"`
+	// MaxSamples is the number of most recent samples kept per workload.
+	MaxSamples int `yaml:"maxSamples"`
+	// Retention is how long the workloads without new samples are kept.
+	Retention Duration `yaml:"retention"`
+}
+
+// NodePoolConfig is a group of nodes, such as spot or highmem nodes.
+type NodePoolConfig struct {
+	Name string `yaml:"name"`
+	// Selector selects the nodes of the pool. Without it, the pool holds the
+	// nodes with the k8s-resource-scheduler/node-pool label set to its name.
+	// A node belongs to the first pool matching it.
+	Selector *NodePoolSelector `yaml:"selector,omitempty"`
+	// ScoreWeights replace the weights of the profile score plugins for the
+	// nodes of the pool, as the scoreWeights of the SchedulingPolicies,
+	// which take precedence over them.
+	ScoreWeights map[string]int64 `yaml:"scoreWeights,omitempty"`
+	// OvercommitRatio multiplies the allocatable CPU and memory of the nodes
+	// for the NodeResourcesFit filter. 0 means 1.
+	OvercommitRatio float64 `yaml:"overcommitRatio,omitempty"`
+	// MaxParallelJobs is the number of running pods scheduled by us the
+	// pool allows, across all its nodes. 0 disables the limit.
+	MaxParallelJobs int `yaml:"maxParallelJobs,omitempty"`
+}
+
+// NodePoolSelector matches the node labels, as a Kubernetes label selector.
+type NodePoolSelector struct {
+	MatchLabels      map[string]string         `yaml:"matchLabels,omitempty"`
+	MatchExpressions []NodeSelectorRequirement `yaml:"matchExpressions,omitempty"`
+}
+
+// DecisionsConfig configures how the explanation of the scheduling
+// decisions is recorded on the pods.
+type DecisionsConfig struct {
+	// Annotation records it in the k8s-resource-scheduler/decision
+	// annotation.
+	Annotation bool `yaml:"annotation"`
+	// Event records it in a SchedulingDecision event.
+	Event bool `yaml:"event"`
+	// MaxSize is the maximum size of the explanation, in bytes. Rejections
+	// and the lowest ranked nodes are left out to fit it. 0 disables the
+	// limit.
+	MaxSize int `yaml:"maxSize"`
+}
+
+// AuditConfig configures the sinks the audit records of the scheduling
+// attempts are written to.
+type AuditConfig struct {
+	File    AuditFileConfig    `yaml:"file"`
+	Webhook AuditWebhookConfig `yaml:"webhook"`
+}
+
+type AuditFileConfig struct {
+	// Path of the audit log, empty to disable it.
+	Path string `yaml:"path"`
+	// MaxSizeMB is the size the audit log is rotated at, 0 disables the
+	// rotation.
+	MaxSizeMB int `yaml:"maxSizeMB"`
+	// MaxBackups is the number of rotated audit logs kept.
+	MaxBackups int `yaml:"maxBackups"`
+}
+
+type AuditWebhookConfig struct {
+	// URL the audit records are posted to, empty to disable it.
+	URL     string   `yaml:"url"`
+	Timeout Duration `yaml:"timeout"`
+}
+
+// ExtenderConfig configures the kube-scheduler extender server, serving the
+// filter and score plugins to a stock kube-scheduler.
+type ExtenderConfig struct {
+	// BindAddress is the address the extender verbs are served on, empty
+	// to disable them.
+	BindAddress string `yaml:"bindAddress"`
+	// Bind enables the bind verb, binding the pods for kube-scheduler.
+	Bind bool `yaml:"bind"`
+}
+
+// PoliciesConfig configures the SchedulingPolicy custom resources, which
+// set how the pods of their namespace are scheduled.
+type PoliciesConfig struct {
+	// Enabled watches the SchedulingPolicies. Their CRD must be installed.
+	Enabled bool `yaml:"enabled"`
+	// ClusterDefault is the SchedulingPolicy, as namespace/name, applying
+	// to all the namespaces, below their own policy.
+	ClusterDefault string `yaml:"clusterDefault"`
+}
+
+type LeaderElectionConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Namespace     string   `yaml:"namespace"`
+	LeaseName     string   `yaml:"leaseName"`
+	LeaseDuration Duration `yaml:"leaseDuration"`
+	RenewDeadline Duration `yaml:"renewDeadline"`
+	RetryPeriod   Duration `yaml:"retryPeriod"`
+}
+
+// HealthConfig sets after how long the liveness checks fail, 0 disabling a
+// check, and what the readiness check requires.
+type HealthConfig struct {
+	// SchedulingTimeout is how long a scheduling attempt can hold the
+	// scheduling lock.
+	SchedulingTimeout Duration `yaml:"schedulingTimeout"`
+	// WatchTimeout is how long each pods watch can go without events or
+	// bookmarks.
+	WatchTimeout Duration `yaml:"watchTimeout"`
+	// MetricsTimeout is how old the freshest node metrics can be.
+	MetricsTimeout Duration `yaml:"metricsTimeout"`
+	// ReadinessRequiresLeader makes the standbys unready, when leader
+	// election is enabled.
+	ReadinessRequiresLeader bool `yaml:"readinessRequiresLeader"`
+}
+
+type LoggingConfig struct {
+	// Level is the minimum level logged: debug, info, warn or error.
+	Level string `yaml:"level"`
+	// Format is logfmt or json.
+	Format string `yaml:"format"`
+}
+
+// ReloadConfig configures where new configurations are picked up from at
+// runtime.
+type ReloadConfig struct {
+	// ConfigMap, as namespace/name, watched for new configurations.
+	ConfigMap string `yaml:"configMap"`
+	// ConfigMapKey is the key of the configuration in the ConfigMap.
+	ConfigMapKey string `yaml:"configMapKey"`
+	// FileInterval is how often the --config file is checked for changes,
+	// 0 disables it.
+	FileInterval Duration `yaml:"fileInterval"`
+}
+
+// Duration is a time.Duration written as a string ("30s") in YAML.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	err := unmarshal(&s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration, err = time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	return nil
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		APIVersion: configAPIVersion,
+		Kind:       configKind,
+		API: APIConfig{
+			Host:            "127.0.0.1:8001",
+			NodeMetricsPath: "/apis/metrics.k8s.io/v1beta1/nodes/%s",
+			PodMetricsPath:  "/apis/metrics.k8s.io/v1beta1/pods",
+		},
+		BindAddress: ":8080",
+		Health: HealthConfig{
+			SchedulingTimeout: Duration{5 * time.Minute},
+			WatchTimeout:      Duration{15 * time.Minute},
+			MetricsTimeout:    Duration{10 * time.Minute},
+
+			ReadinessRequiresLeader: true,
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "logfmt",
+		},
+		Profiles:             []ProfileConfig{{SchedulerName: schedulerName}},
+		Workers:              10,
+		QueueSize:            100,
+		ReconcileInterval:    Duration{30 * time.Second},
+		CacheRefreshInterval: Duration{30 * time.Second},
+		Plugins: PluginsConfig{
+			Filter: []PluginConfig{
+				{Name: "NodeReady"},
+				{Name: "NodeUnschedulable"},
+				{Name: "NodeConditions"},
+				{Name: "NodeSelector"},
+				{Name: "NodePools"},
+				{Name: "NodePorts"},
+				{Name: "VolumeBinding"},
+				{Name: "NodeVolumeLimits"},
+				{Name: "NodeResourcesFit"},
+				{Name: "MaxParallelJobs"},
+			},
+			Score: []PluginConfig{
+				{Name: "LeastUsage", Weight: 1},
+			},
+		},
+		Admission: AdmissionConfig{
+			Mode:               admissionRequests,
+			CPUThreshold:       0.8,
+			MemoryThreshold:    0.8,
+			MaxOvercommitRatio: 3,
+			SettleTime:         Duration{2 * time.Minute},
+		},
+		UsageHistory: UsageHistoryConfig{
+			Interval:   Duration{time.Minute},
+			Percentile: 90,
+			MinSamples: 5,
+			MaxSamples: 500,
+			Retention:  Duration{24 * time.Hour},
+		},
+		Decisions: DecisionsConfig{
+			Annotation: true,
+			MaxSize:    4096,
+		},
+		Audit: AuditConfig{
+			File: AuditFileConfig{
+				MaxSizeMB:  100,
+				MaxBackups: 5,
+			},
+			Webhook: AuditWebhookConfig{
+				Timeout: Duration{5 * time.Second},
+			},
+		},
+		LeaderElection: LeaderElectionConfig{
+			Namespace:     schedulerName,
+			LeaseName:     schedulerName,
+			LeaseDuration: Duration{15 * time.Second},
+			RenewDeadline: Duration{10 * time.Second},
+			RetryPeriod:   Duration{2 * time.Second},
+		},
+		Reload: ReloadConfig{
+			ConfigMapKey: "config.yaml",
+		},
+	}
+}
+
+// validate returns all the problems found in the configuration at once.
+func (c *Config) validate() error {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.APIVersion != configAPIVersion {
+		add("apiVersion: unsupported version %q, expected %q", c.APIVersion, configAPIVersion)
+	}
+	if c.Kind != configKind {
+		add("kind: got %q, expected %q", c.Kind, configKind)
+	}
+	if c.API.PodMetricsPath == "" {
+		add("api.podMetricsPath: must not be empty")
+	}
+	if c.API.Host == "" {
+		add("api.host: must not be empty")
+	}
+	if strings.Count(c.API.NodeMetricsPath, "%s") != 1 {
+		add("api.nodeMetricsPath: must contain exactly one %%s for the node name, got %q", c.API.NodeMetricsPath)
+	}
+	if len(c.Profiles) == 0 {
+		add("profiles: at least one profile is required")
+	}
+	seen := map[string]bool{}
+	for i, p := range c.Profiles {
+		if p.SchedulerName == "" {
+			add("profiles[%d].schedulerName: must not be empty", i)
+		} else if seen[p.SchedulerName] {
+			add("profiles[%d].schedulerName: duplicate profile %q", i, p.SchedulerName)
+		}
+		seen[p.SchedulerName] = true
+		validatePlugins(fmt.Sprintf("profiles[%d].plugins", i), p.Plugins, add)
+		if p.Admission != "" && !validAdmissionMode(p.Admission) {
+			add("profiles[%d].admission: must be requests or usage, got %q", i, p.Admission)
+		}
+	}
+	if c.Health.SchedulingTimeout.Duration < 0 || c.Health.WatchTimeout.Duration < 0 || c.Health.MetricsTimeout.Duration < 0 {
+		add("health: timeouts must not be negative")
+	}
+	if _, ok := logLevelNames[c.Logging.Level]; !ok {
+		add("logging.level: must be one of debug, info, warn or error, got %q", c.Logging.Level)
+	}
+	if c.Logging.Format != "logfmt" && c.Logging.Format != "json" {
+		add("logging.format: must be logfmt or json, got %q", c.Logging.Format)
+	}
+	if c.Workers < 1 {
+		add("workers: must be at least 1, got %d", c.Workers)
+	}
+	if c.QueueSize < 1 {
+		add("queueSize: must be at least 1, got %d", c.QueueSize)
+	}
+	if c.ReconcileInterval.Duration <= 0 {
+		add("reconcileInterval: must be positive, got %s", c.ReconcileInterval)
+	}
+	if c.CacheRefreshInterval.Duration <= 0 {
+		add("cacheRefreshInterval: must be positive, got %s", c.CacheRefreshInterval)
+	}
+	if c.MaxParallelJobs < 0 {
+		add("maxParallelJobs: must not be negative, got %d", c.MaxParallelJobs)
+	}
+
+	validatePlugins("plugins", c.Plugins, add)
+
+	pools := map[string]bool{}
+	for i, p := range c.NodePools {
+		path := fmt.Sprintf("nodePools[%d]", i)
+		if p.Name == "" {
+			add("%s.name: must not be empty", path)
+		} else if pools[p.Name] {
+			add("%s.name: duplicate node pool %q", path, p.Name)
+		}
+		pools[p.Name] = true
+		if p.Selector != nil {
+			for j, r := range p.Selector.MatchExpressions {
+				switch r.Operator {
+				case "In", "NotIn":
+					if len(r.Values) == 0 {
+						add("%s.selector.matchExpressions[%d]: %s needs values", path, j, r.Operator)
+					}
+				case "Exists", "DoesNotExist":
+				default:
+					add("%s.selector.matchExpressions[%d]: operator must be In, NotIn, Exists or DoesNotExist, got %q", path, j, r.Operator)
+				}
+			}
+		}
+		names := []string{}
+		for name := range p.ScoreWeights {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			w := p.ScoreWeights[name]
+			if _, ok := scorePlugins[name]; !ok {
+				add("%s.scoreWeights: unknown score plugin %q (available: %s)", path, name, registeredScorePlugins())
+			} else if w < 0 {
+				add("%s.scoreWeights: weight of %q must not be negative, got %d", path, name, w)
+			}
+		}
+		if p.OvercommitRatio < 0 {
+			add("%s.overcommitRatio: must not be negative, got %g", path, p.OvercommitRatio)
+		}
+		if p.MaxParallelJobs < 0 {
+			add("%s.maxParallelJobs: must not be negative, got %d", path, p.MaxParallelJobs)
+		}
+	}
+
+	if !validAdmissionMode(c.Admission.Mode) {
+		add("admission.mode: must be requests or usage, got %q", c.Admission.Mode)
+	}
+	if c.Admission.CPUThreshold <= 0 || c.Admission.CPUThreshold > 1 || c.Admission.MemoryThreshold <= 0 || c.Admission.MemoryThreshold > 1 {
+		add("admission: cpuThreshold and memoryThreshold must be between 0 and 1")
+	}
+	if c.Admission.MaxOvercommitRatio < 1 {
+		add("admission.maxOvercommitRatio: must be at least 1, got %g", c.Admission.MaxOvercommitRatio)
+	}
+	if c.Admission.SettleTime.Duration < 0 {
+		add("admission.settleTime: must not be negative, got %s", c.Admission.SettleTime)
+	}
+
+	uh := c.UsageHistory
+	if uh.Interval.Duration <= 0 {
+		add("usageHistory.interval: must be positive, got %s", uh.Interval)
+	}
+	if uh.Percentile <= 0 || uh.Percentile > 100 {
+		add("usageHistory.percentile: must be between 0 and 100, got %g", uh.Percentile)
+	}
+	if uh.MinSamples < 1 || uh.MaxSamples < uh.MinSamples {
+		add("usageHistory: minSamples must be at least 1, and maxSamples at least minSamples")
+	}
+	if uh.Retention.Duration <= 0 {
+		add("usageHistory.retention: must be positive, got %s", uh.Retention)
+	}
+
+	if c.Decisions.MaxSize < 0 {
+		add("decisions.maxSize: must not be negative, got %d", c.Decisions.MaxSize)
+	}
+	if c.Audit.File.MaxSizeMB < 0 || c.Audit.File.MaxBackups < 0 {
+		add("audit.file: maxSizeMB and maxBackups must not be negative")
+	}
+	if u := c.Audit.Webhook.URL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		add("audit.webhook.url: must be an http or https URL, got %q", u)
+	}
+	if c.Audit.Webhook.Timeout.Duration <= 0 {
+		add("audit.webhook.timeout: must be positive, got %s", c.Audit.Webhook.Timeout)
+	}
+
+	if c.Policies.ClusterDefault != "" && len(strings.Split(c.Policies.ClusterDefault, "/")) != 2 {
+		add("policies.clusterDefault: must be namespace/name, got %q", c.Policies.ClusterDefault)
+	}
+
+	le := c.LeaderElection
+	if le.Enabled {
+		if le.Namespace == "" || le.LeaseName == "" {
+			add("leaderElection: namespace and leaseName must not be empty")
+		}
+		if le.LeaseDuration.Duration <= le.RenewDeadline.Duration {
+			add("leaderElection.leaseDuration: must be greater than renewDeadline (%s), got %s", le.RenewDeadline, le.LeaseDuration)
+		}
+		if le.RenewDeadline.Duration <= le.RetryPeriod.Duration {
+			add("leaderElection.renewDeadline: must be greater than retryPeriod (%s), got %s", le.RetryPeriod, le.RenewDeadline)
+		}
+		if le.RetryPeriod.Duration <= 0 {
+			add("leaderElection.retryPeriod: must be positive, got %s", le.RetryPeriod)
+		}
+	}
+
+	if c.Reload.ConfigMap != "" && len(strings.Split(c.Reload.ConfigMap, "/")) != 2 {
+		add("reload.configMap: must be namespace/name, got %q", c.Reload.ConfigMap)
+	}
+	if c.Reload.ConfigMap != "" && c.Reload.ConfigMapKey == "" {
+		add("reload.configMapKey: must not be empty")
+	}
+	if c.Reload.FileInterval.Duration < 0 {
+		add("reload.fileInterval: must not be negative, got %s", c.Reload.FileInterval)
+	}
+
+	if len(problems) != 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func validatePlugins(path string, plugins PluginsConfig, add func(string, ...interface{})) {
+	for i, p := range plugins.Filter {
+		if _, ok := filterPlugins[p.Name]; !ok {
+			add("%s.filter[%d]: unknown filter plugin %q (available: %s)", path, i, p.Name, registeredFilterPlugins())
+		}
+	}
+	if len(plugins.Score) == 0 {
+		add("%s.score: at least one score plugin is required", path)
+	}
+	for i, p := range plugins.Score {
+		if _, ok := scorePlugins[p.Name]; !ok {
+			add("%s.score[%d]: unknown score plugin %q (available: %s)", path, i, p.Name, registeredScorePlugins())
+		}
+		if p.Weight < 0 {
+			add("%s.score[%d]: weight of %q must not be negative, got %d", path, i, p.Name, p.Weight)
+		}
+	}
+}
+
+// schedulerNames returns the spec.schedulerName values served.
+func (c *Config) schedulerNames() []string {
+	names := []string{}
+	for _, p := range c.Profiles {
+		names = append(names, p.SchedulerName)
+	}
+	return names
+}
+
+// ownsPod tells whether the pod is ours to schedule: its spec.schedulerName
+// is the name of one of the profiles. The deprecated
+// scheduler.alpha.kubernetes.io/name annotation is ignored, as kube-scheduler
+// does, so that no pod is handled by two schedulers.
+func (c *Config) ownsPod(pod *Pod) bool {
+	return contains(c.schedulerNames(), pod.Spec.SchedulerName)
+}
+
+// profileList is a flag replacing the profiles with one profile per given
+// scheduler name. It can be repeated, or given a comma separated list.
+type profileList struct {
+	profiles *[]ProfileConfig
+	set      bool
+}
+
+func (p *profileList) String() string {
+	if p.profiles == nil {
+		return ""
+	}
+	names := []string{}
+	for _, pc := range *p.profiles {
+		names = append(names, pc.SchedulerName)
+	}
+	return strings.Join(names, ",")
+}
+
+func (p *profileList) Set(v string) error {
+	if !p.set {
+		*p.profiles = nil
+		p.set = true
+	}
+	for _, name := range strings.Split(v, ",") {
+		*p.profiles = append(*p.profiles, ProfileConfig{SchedulerName: name})
+	}
+	return nil
+}
+
+// pluginList is a flag enabling a list of plugins, as "Name" or
+// "Name=weight".
+type pluginList struct {
+	plugins *[]PluginConfig
+	set     bool
+}
+
+func (p *pluginList) String() string {
+	if p.plugins == nil {
+		return ""
+	}
+	names := []string{}
+	for _, pc := range *p.plugins {
+		if pc.Weight != 0 {
+			names = append(names, fmt.Sprintf("%s=%d", pc.Name, pc.Weight))
+		} else {
+			names = append(names, pc.Name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (p *pluginList) Set(v string) error {
+	if !p.set {
+		*p.plugins = nil
+		p.set = true
+	}
+	for _, s := range strings.Split(v, ",") {
+		pc := PluginConfig{Name: s}
+		if i := strings.Index(s, "="); i != -1 {
+			w, err := strconv.ParseInt(s[i+1:], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid weight in %q", s)
+			}
+			pc = PluginConfig{Name: s[:i], Weight: w}
+		}
+		*p.plugins = append(*p.plugins, pc)
+	}
+	return nil
+}
+
+// configFlags binds the command line flags to cfg. extra registers the flags
+// of a subcommand.
+func configFlags(cfg *Config, extra ...func(fs *flag.FlagSet)) *flag.FlagSet {
+	fs := flag.NewFlagSet(schedulerName, flag.ContinueOnError)
+	fs.String("config", "", "Path to the scheduler configuration file")
+	fs.Bool("print-default-config", false, "Print the default configuration and exit")
+
+	fs.StringVar(&cfg.API.Host, "api-host", cfg.API.Host, "Address of the Kubernetes API server (or kubectl proxy)")
+	fs.StringVar(&cfg.API.NodeMetricsPath, "node-metrics-path", cfg.API.NodeMetricsPath, "Path of the node metrics endpoint, %s is replaced by the node name")
+	fs.StringVar(&cfg.API.PodMetricsPath, "pod-metrics-path", cfg.API.PodMetricsPath, "Path of the pod metrics endpoint")
+	fs.StringVar(&cfg.BindAddress, "bind-address", cfg.BindAddress, "Address to serve /metrics, /healthz and /readyz on, empty to disable them")
+	fs.DurationVar(&cfg.Health.SchedulingTimeout.Duration, "health-scheduling-timeout", cfg.Health.SchedulingTimeout.Duration, "Fail the liveness check when a scheduling attempt takes longer, 0 disables the check")
+	fs.DurationVar(&cfg.Health.WatchTimeout.Duration, "health-watch-timeout", cfg.Health.WatchTimeout.Duration, "Fail the liveness check when the pods watch gets no events or bookmarks for longer, 0 disables the check")
+	fs.DurationVar(&cfg.Health.MetricsTimeout.Duration, "health-metrics-timeout", cfg.Health.MetricsTimeout.Duration, "Fail the liveness check when node metrics are older, 0 disables the check")
+	fs.BoolVar(&cfg.Health.ReadinessRequiresLeader, "health-readiness-requires-leader", cfg.Health.ReadinessRequiresLeader, "Fail the readiness check on the standbys, when leader election is enabled")
+	fs.StringVar(&cfg.Logging.Level, "log-level", cfg.Logging.Level, "Minimum level logged: debug, info, warn or error")
+	fs.StringVar(&cfg.Logging.Format, "log-format", cfg.Logging.Format, "Format of the logs: logfmt or json")
+	fs.Var(&profileList{profiles: &cfg.Profiles}, "scheduler-name", "Scheduler name to serve with the default plugins, replacing the configured profiles (repeatable, or comma separated)")
+	fs.BoolVar(&cfg.Shadow, "shadow", cfg.Shadow, "Run in shadow mode: compare where the pods would be placed with where they get bound, without binding them")
+	fs.IntVar(&cfg.Workers, "workers", cfg.Workers, "Number of workers scheduling queued pods")
+	fs.IntVar(&cfg.QueueSize, "queue-size", cfg.QueueSize, "Size of the scheduling queue")
+	fs.DurationVar(&cfg.ReconcileInterval.Duration, "reconcile-interval", cfg.ReconcileInterval.Duration, "Interval between full reconciliations of unscheduled pods")
+	fs.DurationVar(&cfg.CacheRefreshInterval.Duration, "cache-refresh-interval", cfg.CacheRefreshInterval.Duration, "Interval between cluster state refreshes")
+	fs.IntVar(&cfg.MaxParallelJobs, "max-parallel-jobs", cfg.MaxParallelJobs, "Maximum number of running pods per node, 0 disables the limit")
+	fs.Var(&pluginList{plugins: &cfg.Plugins.Filter}, "filter-plugins", "Comma separated list of the default filter plugins")
+	fs.Var(&pluginList{plugins: &cfg.Plugins.Score}, "score-plugins", "Comma separated list of the default score plugins, as Name=weight")
+	fs.StringVar(&cfg.Admission.Mode, "admission-mode", cfg.Admission.Mode, "How pods are admitted on the nodes: requests, or usage for their predicted usage")
+	fs.Float64Var(&cfg.Admission.CPUThreshold, "usage-cpu-threshold", cfg.Admission.CPUThreshold, "Share of the allocatable CPU the predicted usage must stay under, in usage admission mode")
+	fs.Float64Var(&cfg.Admission.MemoryThreshold, "usage-memory-threshold", cfg.Admission.MemoryThreshold, "Share of the allocatable memory the predicted usage must stay under, in usage admission mode")
+	fs.Float64Var(&cfg.Admission.MaxOvercommitRatio, "max-overcommit-ratio", cfg.Admission.MaxOvercommitRatio, "Ratio of the allocatable resources the requests are capped at, in usage admission mode")
+	fs.BoolVar(&cfg.UsageHistory.Enabled, "usage-history", cfg.UsageHistory.Enabled, "Learn the usage of the workloads from the pod metrics, and estimate the usage of their pods from it")
+	fs.Float64Var(&cfg.UsageHistory.Percentile, "usage-history-percentile", cfg.UsageHistory.Percentile, "Percentile of the usage history of a workload its pods are expected to use")
+	fs.DurationVar(&cfg.UsageHistory.Interval.Duration, "usage-history-interval", cfg.UsageHistory.Interval.Duration, "Interval between collections of the pod metrics")
+
+	fs.BoolVar(&cfg.Decisions.Annotation, "decision-annotation", cfg.Decisions.Annotation, "Record the explanation of the scheduling decisions in a pod annotation")
+	fs.BoolVar(&cfg.Decisions.Event, "decision-event", cfg.Decisions.Event, "Record the explanation of the scheduling decisions in a pod event")
+	fs.IntVar(&cfg.Decisions.MaxSize, "decision-max-size", cfg.Decisions.MaxSize, "Maximum size in bytes of the explanation of the scheduling decisions, 0 disables the limit")
+
+	fs.StringVar(&cfg.Audit.File.Path, "audit-file", cfg.Audit.File.Path, "Path of the audit log of the scheduling attempts, empty to disable it")
+	fs.IntVar(&cfg.Audit.File.MaxSizeMB, "audit-file-max-size", cfg.Audit.File.MaxSizeMB, "Size in megabytes the audit log is rotated at, 0 disables the rotation")
+	fs.IntVar(&cfg.Audit.File.MaxBackups, "audit-file-max-backups", cfg.Audit.File.MaxBackups, "Number of rotated audit logs kept")
+	fs.StringVar(&cfg.Audit.Webhook.URL, "audit-webhook-url", cfg.Audit.Webhook.URL, "URL the audit records of the scheduling attempts are posted to, empty to disable it")
+	fs.DurationVar(&cfg.Audit.Webhook.Timeout.Duration, "audit-webhook-timeout", cfg.Audit.Webhook.Timeout.Duration, "Timeout of the audit webhook requests")
+
+	fs.StringVar(&cfg.Extender.BindAddress, "extender-bind-address", cfg.Extender.BindAddress, "Address to serve the kube-scheduler extender verbs on, empty to disable them")
+	fs.BoolVar(&cfg.Extender.Bind, "extender-bind", cfg.Extender.Bind, "Serve the extender bind verb, binding the pods for kube-scheduler")
+
+	fs.BoolVar(&cfg.Policies.Enabled, "scheduling-policies", cfg.Policies.Enabled, "Watch the SchedulingPolicy custom resources and apply them to the pods of their namespace")
+	fs.StringVar(&cfg.Policies.ClusterDefault, "cluster-default-policy", cfg.Policies.ClusterDefault, "SchedulingPolicy (namespace/name) applying to all the namespaces, below their own policy")
+
+	fs.BoolVar(&cfg.LeaderElection.Enabled, "leader-elect", cfg.LeaderElection.Enabled, "Enable leader election, to run multiple replicas")
+	fs.StringVar(&cfg.LeaderElection.Namespace, "leader-elect-namespace", cfg.LeaderElection.Namespace, "Namespace of the leader election Lease")
+	fs.StringVar(&cfg.LeaderElection.LeaseName, "leader-elect-lease-name", cfg.LeaderElection.LeaseName, "Name of the leader election Lease")
+	fs.DurationVar(&cfg.LeaderElection.LeaseDuration.Duration, "leader-elect-lease-duration", cfg.LeaderElection.LeaseDuration.Duration, "How long standbys wait before taking over a lease which is not renewed")
+	fs.DurationVar(&cfg.LeaderElection.RenewDeadline.Duration, "leader-elect-renew-deadline", cfg.LeaderElection.RenewDeadline.Duration, "How long the leader retries renewing the lease before giving up leadership")
+	fs.DurationVar(&cfg.LeaderElection.RetryPeriod.Duration, "leader-elect-retry-period", cfg.LeaderElection.RetryPeriod.Duration, "Interval between attempts to acquire or renew the lease")
+
+	fs.StringVar(&cfg.Reload.ConfigMap, "config-map", cfg.Reload.ConfigMap, "ConfigMap (namespace/name) watched for configuration changes")
+	fs.StringVar(&cfg.Reload.ConfigMapKey, "config-map-key", cfg.Reload.ConfigMapKey, "Key of the configuration in the ConfigMap")
+	fs.DurationVar(&cfg.Reload.FileInterval.Duration, "config-reload-interval", cfg.Reload.FileInterval.Duration, "How often the configuration file is checked for changes, 0 disables it")
+
+	for _, register := range extra {
+		register(fs)
+	}
+	return fs
+}
+
+// parseConfig builds the configuration from the defaults, the configuration
+// file given with --config and finally the command line flags. It returns
+// nil if --print-default-config was given, after printing it.
+func parseConfig(args []string, extra ...func(fs *flag.FlagSet)) (*Config, error) {
+	cfg := defaultConfig()
+	fs := configFlags(cfg, extra...)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.Lookup("print-default-config").Value.String() == "true" {
+		b, err := yaml.Marshal(defaultConfig())
+		if err != nil {
+			return nil, err
+		}
+		os.Stdout.Write(b)
+		return nil, nil
+	}
+
+	if path := fs.Lookup("config").Value.String(); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := parseConfigData(path, b, args, extra...)
+		if cfg != nil {
+			cfg.file = path
+		}
+		return cfg, err
+	}
+
+	return finishConfig(cfg)
+}
+
+// parseConfigData builds the configuration from the content of a
+// configuration file, read from source. Fields missing from the file keep
+// their default value, lists given in the file replace the default ones.
+// Command line flags take precedence over the file.
+func parseConfigData(source string, b []byte, args []string, extra ...func(fs *flag.FlagSet)) (*Config, error) {
+	cfg := defaultConfig()
+	err := yaml.UnmarshalStrict(b, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", source, err.Error())
+	}
+
+	err = configFlags(cfg, extra...).Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return finishConfig(cfg)
+}
+
+func finishConfig(cfg *Config) (*Config, error) {
+	// MAX_PARALLEL_JOBS was the only knob before the configuration file.
+	if env := os.Getenv("MAX_PARALLEL_JOBS"); env != "" && cfg.MaxParallelJobs == 0 {
+		v, err := strconv.Atoi(env)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAX_PARALLEL_JOBS: %s", err.Error())
+		}
+		cfg.MaxParallelJobs = v
+	}
+
+	cfg.complete()
+	return cfg, cfg.validate()
+}
+
+// complete fills in the values which default to other ones: the plugins of
+// the profiles default to the top level ones, and weights default to 1.
+func (c *Config) complete() {
+	completeWeights(c.Plugins.Score)
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		if p.Plugins.Filter == nil {
+			p.Plugins.Filter = append([]PluginConfig{}, c.Plugins.Filter...)
+		}
+		if p.Plugins.Score == nil {
+			p.Plugins.Score = append([]PluginConfig{}, c.Plugins.Score...)
+		}
+		completeWeights(p.Plugins.Score)
+	}
+}
+
+func completeWeights(plugins []PluginConfig) {
+	for i := range plugins {
+		if plugins[i].Weight == 0 {
+			plugins[i].Weight = 1
+		}
+	}
+}
+
+var configLock sync.RWMutex
+var activeConfig *Config
+
+// activeProfiles are the frameworks of the profiles, by scheduler name.
+var activeProfiles map[string]*framework
+
+// namesChanged is closed, and replaced, when the scheduler names served
+// change.
+var namesChanged = make(chan struct{})
+
+// applyConfig makes cfg the configuration in use.
+func applyConfig(cfg *Config) error {
+	profiles := map[string]*framework{}
+	for _, p := range cfg.Profiles {
+		f, err := newFramework(cfg, p)
+		if err != nil {
+			return fmt.Errorf("profile %s: %s", p.SchedulerName, err.Error())
+		}
+		profiles[p.SchedulerName] = f
+	}
+
+	err := setLogging(cfg.Logging.Level, cfg.Logging.Format)
+	if err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	if activeConfig != nil && strings.Join(activeConfig.schedulerNames(), ",") != strings.Join(cfg.schedulerNames(), ",") {
+		close(namesChanged)
+		namesChanged = make(chan struct{})
+	}
+	activeConfig = cfg
+	activeProfiles = profiles
+	return nil
+}
+
+// schedulerNamesChanged returns a channel closed when the scheduler names
+// served change.
+func schedulerNamesChanged() <-chan struct{} {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return namesChanged
+}
+
+// currentConfig returns the configuration in use. It must not be modified.
+func currentConfig() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return activeConfig
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+const decisionAnnotation = schedulerName + "/decision"
+
+// Decision explains a scheduling decision: how many nodes were considered,
+// why the filters rejected some of them and how the others ranked. It holds
+// no timestamp, so that the retries of an unschedulable pod yield the same
+// decision and neither re-patch the pod nor break the event series.
+type Decision struct {
+	Profile    string            `json:"profile"`
+	Candidates int               `json:"candidates"`
+	Selected   string            `json:"selected,omitempty"`
+	Rejected   map[string]string `json:"rejected,omitempty"`
+	Ranking    []NodeScore       `json:"ranking,omitempty"`
+
+	// OmittedRejected and OmittedRanking count the entries left out to
+	// keep the decision within the size limit.
+	OmittedRejected int `json:"omittedRejected,omitempty"`
+	OmittedRanking  int `json:"omittedRanking,omitempty"`
+}
+
+// newDecision builds the decision from the outcome of the filters and the
+// node scores. selected is empty when the pod could not be scheduled.
+func newDecision(profile string, fr *fitResult, scores []NodeScore, selected string) Decision {
+	ranking := append([]NodeScore{}, scores...)
+	// Stable, so the selected node stays first among the nodes with the
+	// same score.
+	sort.SliceStable(ranking, func(i, j int) bool {
+		return ranking[i].Score > ranking[j].Score
+	})
+
+	return Decision{
+		Profile:    profile,
+		Candidates: len(fr.nodes),
+		Selected:   selected,
+		Rejected:   fr.failures,
+		Ranking:    ranking,
+	}
+}
+
+// encode returns the decision as JSON, at most maxSize bytes long (0 for no
+// limit). The rejections are left out first, then the lowest ranked nodes,
+// but the selected node is always kept.
+func (d Decision) encode(maxSize int) ([]byte, error) {
+	b, err := json.Marshal(d)
+	if err != nil || maxSize <= 0 || len(b) <= maxSize {
+		return b, err
+	}
+
+	// Work on a copy of the rejections, they are shared with the caller.
+	failures := d.Rejected
+	d.Rejected = make(map[string]string, len(failures))
+	rejected := make([]string, 0, len(failures))
+	for node, reason := range failures {
+		d.Rejected[node] = reason
+		rejected = append(rejected, node)
+	}
+	sort.Strings(rejected)
+
+	for len(b) > maxSize {
+		// Drop entries in proportion to the excess, to avoid encoding
+		// large decisions once per entry.
+		drop := func(n int) int {
+			k := n * (len(b) - maxSize) / len(b)
+			if k < 1 {
+				k = 1
+			}
+			if k > n {
+				k = n
+			}
+			return k
+		}
+
+		switch {
+		case len(rejected) > 0:
+			k := drop(len(rejected))
+			for _, node := range rejected[len(rejected)-k:] {
+				delete(d.Rejected, node)
+			}
+			rejected = rejected[:len(rejected)-k]
+			d.OmittedRejected += k
+		case len(d.Ranking) > 1:
+			k := drop(len(d.Ranking) - 1)
+			d.Ranking = d.Ranking[:len(d.Ranking)-k]
+			d.OmittedRanking += k
+		default:
+			return nil, fmt.Errorf("decision does not fit in %d bytes", maxSize)
+		}
+
+		b, err = json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// recordDecision attaches the decision to the pod, as an annotation and/or
+// an event depending on the configuration. Failures are only logged, they
+// don't affect the scheduling of the pod.
+func recordDecision(log *Logger, pod *Pod, d Decision) {
+	cfg := currentConfig().Decisions
+	if !cfg.Annotation && !cfg.Event {
+		return
+	}
+
+	b, err := d.encode(cfg.MaxSize)
+	if err != nil {
+		log.Warn("Failed encoding scheduling decision", "err", err)
+		return
+	}
+	log.Debug("Scheduling decision", "decision", string(b))
+
+	if cfg.Annotation && pod.Metadata.Annotations[decisionAnnotation] != string(b) {
+		err := annotatePod(pod, decisionAnnotation, string(b))
+		if err != nil {
+			log.Warn("Failed annotating pod with the scheduling decision", "err", err)
+		}
+	}
+
+	if cfg.Event {
+		// Event notes are limited in size by the API.
+		if len(b) > maxEventNoteSize {
+			b, err = d.encode(maxEventNoteSize)
+			if err != nil {
+				log.Warn("Failed encoding scheduling decision", "err", err)
+				return
+			}
+		}
+		err := recorder.record(d.Profile, objectReference(pod), "Normal", "SchedulingDecision", "Scheduling", string(b))
+		if err != nil {
+			log.Warn("Failed posting scheduling decision event", "err", err)
+		}
+	}
+}
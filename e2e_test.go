@@ -0,0 +1,774 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startScheduler runs the scheduling loops against the fake API server,
+// configured with the given command line flags, until the end of the test.
+func startScheduler(t *testing.T, args ...string) {
+	cfg, err := parseConfig(append([]string{"--log-level=warn", "--cache-refresh-interval=100ms"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache = &schedulerCache{}
+	// The watches of the previous tests may still be stopping.
+	health.Lock()
+	health.processingSince = time.Time{}
+	health.watches = nil
+	health.Unlock()
+	lastAllocation = nil
+	queueLock.Lock()
+	queuedPods = map[string]string{}
+	queueLock.Unlock()
+	trackedLock.Lock()
+	trackedPods = map[string]*Pod{}
+	trackedLock.Unlock()
+	recorder = newEventRecorder()
+	policies = &policyStore{}
+	assumedUsage = &usageLedger{}
+	usageHistory = &usageHistoryStore{}
+	Queue = make(chan *Pod, cfg.QueueSize)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go cache.run(cfg.CacheRefreshInterval.Duration, stop, &wg)
+	if cfg.Policies.Enabled {
+		wg.Add(1)
+		go policies.run(stop, &wg)
+	}
+	if cfg.UsageHistory.Enabled {
+		wg.Add(1)
+		go usageHistory.run(cfg.UsageHistory.Interval.Duration, stop, &wg)
+	}
+	wg.Add(1)
+	go func() {
+		runScheduler(stop)
+		wg.Done()
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		wg.Wait()
+	})
+	if cfg.Policies.Enabled {
+		eventually(t, scheduleTimeout, policies.synced, "scheduling policies not synced")
+	}
+}
+
+func newTestPod(name, cpu, memory string) *Pod {
+	return &Pod{
+		Metadata: Metadata{Name: name, Namespace: "default"},
+		Spec: PodSpec{
+			SchedulerName: schedulerName,
+			Containers: []Container{
+				{Name: "job", Resources: ResourceRequirements{Requests: ResourceList{"cpu": cpu, "memory": memory}}},
+			},
+		},
+	}
+}
+
+const scheduleTimeout = 10 * time.Second
+
+func TestScheduleFromWatch(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("busy", "4", "8Gi", "3500m", "7Gi")
+	api.addNode("idle", "4", "8Gi", "500m", "1Gi")
+	startScheduler(t)
+
+	api.addPod(newTestPod("job-1", "1", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-1") != "" }, "job-1 was not bound")
+
+	if node := api.boundNode("default", "job-1"); node != "idle" {
+		t.Fatalf("expected job-1 on the least used node, got %s", node)
+	}
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-1", "Scheduled")) == 1 }, "no Scheduled event for job-1")
+
+	eventually(t, scheduleTimeout, func() bool {
+		return api.pod("default", "job-1").Metadata.Annotations[decisionAnnotation] != ""
+	}, "job-1 has no decision annotation")
+	d := Decision{}
+	err := json.Unmarshal([]byte(api.pod("default", "job-1").Metadata.Annotations[decisionAnnotation]), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Selected != "idle" || d.Candidates != 2 || len(d.Ranking) != 2 || d.Ranking[1].Node != "busy" {
+		t.Errorf("unexpected decision %+v", d)
+	}
+}
+
+func TestSchedulePendingBeforeStart(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("worker-1", "4", "8Gi", "1", "1Gi")
+	api.addPod(newTestPod("job-1", "1", "1Gi"))
+	api.addPod(newTestPod("job-2", "1", "1Gi"))
+	startScheduler(t)
+
+	for _, name := range []string{"job-1", "job-2"} {
+		name := name
+		eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", name) == "worker-1" }, "%s was not bound", name)
+	}
+}
+
+func TestScheduleUnschedulable(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("small", "2", "4Gi", "100m", "1Gi")
+	startScheduler(t)
+
+	api.addPod(newTestPod("big", "4", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return api.eventCount("big", "FailedScheduling") != 0 }, "no FailedScheduling event")
+	if n := api.bindingCount("default", "big"); n != 0 {
+		t.Fatalf("expected no binding for a pod which fits no node, got %d", n)
+	}
+	eventually(t, scheduleTimeout, func() bool { return api.podScheduled("default", "big").Status == "False" }, "big has no PodScheduled condition")
+	c := api.podScheduled("default", "big")
+	if c.Reason != "Unschedulable" || c.Message != "0/1 nodes are available: 1 Insufficient cpu." || c.LastTransitionTime == "" {
+		t.Errorf("unexpected PodScheduled condition %+v", c)
+	}
+
+	// The pod is retried, and bound once a node can fit it.
+	eventually(t, scheduleTimeout, func() bool { return api.eventCount("big", "FailedScheduling") > 1 }, "big was not retried")
+	api.addNode("large", "8", "16Gi", "100m", "1Gi")
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "big") == "large" }, "big was not bound once it fit")
+	eventually(t, scheduleTimeout, func() bool { return api.podScheduled("default", "big").Status == "True" }, "the PodScheduled condition of big was not cleared")
+	if c := api.podScheduled("default", "big"); c.Reason != "" || c.Message != "" {
+		t.Errorf("expected the reason and message of the PodScheduled condition to be cleared, got %+v", c)
+	}
+}
+
+func TestFailedSchedulingEvent(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("small", "1", "4Gi", "100m", "1Gi")
+	api.addNode("other", "8", "16Gi", "100m", "1Gi")
+	startScheduler(t)
+
+	pod := newTestPod("big", "2", "1Gi")
+	pod.Metadata.Namespace = "jobs"
+	pod.Spec.NodeSelector = map[string]string{"kubernetes.io/hostname": "small"}
+	api.addPod(pod)
+
+	// The retries are aggregated into the series of a single event.
+	eventually(t, scheduleTimeout, func() bool { return api.eventCount("big", "FailedScheduling") > 1 }, "big was not retried")
+	events := api.eventsFor("big", "FailedScheduling")
+	if len(events) != 1 {
+		t.Fatalf("expected a single FailedScheduling event, got %d", len(events))
+	}
+	e := events[0]
+	if e.Metadata.Namespace != "jobs" || e.Regarding.Namespace != "jobs" || e.ReportingController != schedulerName || e.Type != "Warning" {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if expected := "0/2 nodes are available: 1 Insufficient cpu, 1 node(s) didn't match node selector."; e.Note != expected {
+		t.Errorf("expected note %q, got %q", expected, e.Note)
+	}
+}
+
+func TestScheduleNodeSelector(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("idle", "4", "8Gi", "100m", "1Gi")
+	api.addNode("selected", "4", "8Gi", "3", "6Gi")
+	startScheduler(t)
+
+	pod := newTestPod("job-1", "500m", "1Gi")
+	pod.Spec.NodeSelector = map[string]string{"kubernetes.io/hostname": "selected"}
+	api.addPod(pod)
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-1") != "" }, "job-1 was not bound")
+
+	if node := api.boundNode("default", "job-1"); node != "selected" {
+		t.Fatalf("expected job-1 on the node matching its selector, got %s", node)
+	}
+}
+
+func TestScheduleDeletedPodDropped(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("small", "2", "4Gi", "100m", "1Gi")
+	startScheduler(t)
+
+	api.addPod(newTestPod("big", "4", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return api.eventCount("big", "FailedScheduling") != 0 }, "no FailedScheduling event")
+
+	api.deletePod("default", "big")
+	eventually(t, scheduleTimeout, func() bool {
+		return queueDepths()[unschedulableQueue] == 0 && trackedPod(&Pod{Metadata: Metadata{Namespace: "default", Name: "big"}}) == nil
+	}, "big was not dropped from the queue")
+
+	// An attempt may have been under way when the pod got deleted, none
+	// starts after it.
+	attempts := api.eventCount("big", "FailedScheduling")
+	time.Sleep(3 * time.Second)
+	if n := api.eventCount("big", "FailedScheduling"); n > attempts+1 {
+		t.Errorf("expected the deleted pod not to be retried, got %d more attempts", n-attempts)
+	}
+}
+
+func TestBindConflictNotRetried(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("worker-1", "4", "8Gi", "100m", "1Gi")
+	cfg, err := parseConfig([]string{"--log-level=warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache = &schedulerCache{}
+	Queue = make(chan *Pod, 1)
+
+	// The pod gets bound by another attempt after we saw it pending.
+	pod := newTestPod("job-1", "1", "1Gi")
+	api.addPod(pod)
+	pending := *pod
+	api.updatePod("default", "job-1", func(p *Pod) { p.Spec.NodeName = "worker-1" })
+
+	trackPod(&pending)
+	err = schedulePod(&pending)
+	if err != nil {
+		t.Fatalf("expected the conflict to be treated as already bound, got %s", err)
+	}
+	if n := api.bindingCount("default", "job-1"); n != 1 {
+		t.Errorf("expected one binding attempt, got %d", n)
+	}
+	if trackedPod(&pending) != nil || len(Queue) != 0 {
+		t.Errorf("expected the pod to be dropped, not queued")
+	}
+}
+
+func TestForeignPodsNeverBound(t *testing.T) {
+	for _, test := range []struct {
+		name              string
+		unsupportedFields []string
+	}{
+		{name: "field selectors"},
+		// The pods of the other schedulers reach the scheduler, which
+		// must leave them alone.
+		{name: "client side checks", unsupportedFields: []string{"spec.schedulerName"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			api := startFakeAPIServer(t)
+			for _, field := range test.unsupportedFields {
+				api.unsupportedFields[field] = true
+			}
+			api.addNode("worker-1", "8", "16Gi", "100m", "1Gi")
+
+			foreign := []*Pod{
+				newTestPod("default-scheduler", "1", "1Gi"),
+				newTestPod("other-scheduler", "1", "1Gi"),
+				newTestPod("deprecated-annotation", "1", "1Gi"),
+			}
+			foreign[0].Spec.SchedulerName = "default-scheduler"
+			foreign[1].Spec.SchedulerName = "other-scheduler"
+			foreign[2].Spec.SchedulerName = "default-scheduler"
+			foreign[2].Metadata.Annotations = map[string]string{"scheduler.alpha.kubernetes.io/name": schedulerName}
+			for _, p := range foreign {
+				api.addPod(p)
+			}
+
+			startScheduler(t, "--scheduler-name="+schedulerName+",batch", "--reconcile-interval=1s")
+			ours := []*Pod{newTestPod("job-1", "1", "1Gi"), newTestPod("job-2", "1", "1Gi")}
+			ours[1].Spec.SchedulerName = "batch"
+			for _, p := range ours {
+				api.addPod(p)
+			}
+			for _, p := range ours {
+				name := p.Metadata.Name
+				eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", name) != "" }, "%s was not bound", name)
+			}
+
+			// Leave the reconciliation time to go through the pods.
+			time.Sleep(2 * time.Second)
+			for _, p := range foreign {
+				if n := api.bindingCount("default", p.Metadata.Name); n != 0 {
+					t.Errorf("expected %s of %s never to be bound, got %d bindings", p.Metadata.Name, p.Spec.SchedulerName, n)
+				}
+			}
+		})
+	}
+}
+
+func TestSchedulerNamesReloaded(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("worker-1", "8", "16Gi", "100m", "1Gi")
+	startScheduler(t)
+
+	pod := newTestPod("job-1", "1", "1Gi")
+	pod.Spec.SchedulerName = "batch"
+	api.addPod(pod)
+	time.Sleep(time.Second)
+	if n := api.bindingCount("default", "job-1"); n != 0 {
+		t.Fatalf("expected the pod of an unknown profile not to be bound, got %d bindings", n)
+	}
+
+	cfg, err := parseConfig([]string{"--log-level=warn", "--scheduler-name=" + schedulerName + ",batch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-1") == "worker-1" }, "job-1 was not bound once its profile was added")
+}
+
+func TestMaxParallelJobsCountsOwnPods(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("worker-1", "8", "16Gi", "100m", "1Gi")
+	running := newTestPod("foreign", "1", "1Gi")
+	running.Spec.SchedulerName = "default-scheduler"
+	running.Spec.NodeName = "worker-1"
+	running.Status.Phase = "Running"
+	api.addPod(running)
+	startScheduler(t, "--max-parallel-jobs=1")
+
+	// The running pod of another scheduler doesn't count.
+	api.addPod(newTestPod("job-1", "1", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-1") == "worker-1" }, "job-1 was not bound")
+}
+
+func TestNodeConditionFilters(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("cordoned", "8", "16Gi", "100m", "1Gi").Spec.Unschedulable = true
+	pressure := api.addNode("pressure", "8", "16Gi", "100m", "1Gi")
+	pressure.Status.Conditions = append(pressure.Status.Conditions, Condition{Type: "MemoryPressure", Status: "True"}, Condition{Type: "DiskPressure", Status: "False"})
+	offline := api.addNode("offline", "8", "16Gi", "100m", "1Gi")
+	offline.Status.Conditions = append(offline.Status.Conditions, Condition{Type: "NetworkUnavailable", Status: "True"})
+	api.addNode("not-ready", "8", "16Gi", "100m", "1Gi").Status.Conditions = []Condition{{Type: "Ready", Status: "False"}}
+	startScheduler(t)
+
+	api.addPod(newTestPod("job-1", "1", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-1", "FailedScheduling")) != 0 }, "no FailedScheduling event")
+	expected := "0/4 nodes are available: 1 node(s) had memory pressure, 1 node(s) had unavailable network, 1 node(s) were not ready, 1 node(s) were unschedulable."
+	if note := api.eventsFor("job-1", "FailedScheduling")[0].Note; note != expected {
+		t.Errorf("expected note %q, got %q", expected, note)
+	}
+
+	tolerant := newTestPod("job-2", "1", "1Gi")
+	tolerant.Metadata.Annotations = map[string]string{schedulerName + "/tolerate-node-conditions": "DiskPressure, MemoryPressure"}
+	api.addPod(tolerant)
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-2") == "pressure" }, "job-2 was not bound to the node under memory pressure")
+}
+
+func TestScheduleWithoutStorageAccess(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("worker-1", "4", "8Gi", "1", "1Gi")
+	api.forbid(csiNodesEndpoint)
+	startScheduler(t)
+
+	api.addPod(newTestPod("job-1", "1", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-1") == "worker-1" }, "job-1 was not bound")
+}
+
+func TestVolumeTopologyAndLimits(t *testing.T) {
+	api := startFakeAPIServer(t)
+	const zone = "topology.kubernetes.io/zone"
+	api.addNode("a-1", "8", "16Gi", "2", "4Gi").Metadata.Labels[zone] = "a"
+	api.addNode("a-2", "8", "16Gi", "0", "0").Metadata.Labels[zone] = "a"
+	api.addNode("b-1", "8", "16Gi", "6", "12Gi").Metadata.Labels[zone] = "b"
+
+	className := "zonal-a"
+	limit := int32(1)
+	api.addVolumes(ClusterVolumes{
+		Claims: []PersistentVolumeClaim{
+			{Metadata: Metadata{Name: "data-db", Namespace: "default"}, Spec: PersistentVolumeClaimSpec{VolumeName: "pv-db"}},
+			{Metadata: Metadata{Name: "data-b", Namespace: "default"}, Spec: PersistentVolumeClaimSpec{VolumeName: "pv-b"}},
+			{Metadata: Metadata{Name: "data-new", Namespace: "default"}, Spec: PersistentVolumeClaimSpec{StorageClassName: &className}},
+		},
+		Volumes: []PersistentVolume{
+			{Metadata: Metadata{Name: "pv-db"}, Spec: PersistentVolumeSpec{CSI: &CSIPersistentVolumeSource{Driver: "csi.example.com", VolumeHandle: "vol-db"}}},
+			{
+				Metadata: Metadata{Name: "pv-b"},
+				Spec: PersistentVolumeSpec{
+					CSI: &CSIPersistentVolumeSource{Driver: "csi.example.com", VolumeHandle: "vol-b"},
+					NodeAffinity: &VolumeNodeAffinity{Required: &NodeSelector{NodeSelectorTerms: []NodeSelectorTerm{
+						{MatchExpressions: []NodeSelectorRequirement{{Key: zone, Operator: "In", Values: []string{"b"}}}},
+					}}},
+				},
+			},
+		},
+		Classes: []StorageClass{{
+			Metadata:          Metadata{Name: className},
+			Provisioner:       "csi.example.com",
+			VolumeBindingMode: "WaitForFirstConsumer",
+			AllowedTopologies: []TopologySelectorTerm{{MatchLabelExpressions: []TopologySelectorLabelRequirement{{Key: zone, Values: []string{"a"}}}}},
+		}},
+		CSINodes: []CSINode{{
+			Metadata: Metadata{Name: "a-2"},
+			Spec:     CSINodeSpec{Drivers: []CSINodeDriver{{Name: "csi.example.com", NodeID: "a-2", Allocatable: &VolumeNodeResources{Count: &limit}}}},
+		}},
+	})
+
+	withClaim := func(pod *Pod, claim string) *Pod {
+		pod.Spec.Volumes = []Volume{{Name: "data", PersistentVolumeClaim: &PersistentVolumeClaimVolumeSource{ClaimName: claim}}}
+		return pod
+	}
+	db := withClaim(newTestPod("db", "1", "1Gi"), "data-db")
+	db.Spec.NodeName = "a-2"
+	db.Status.Phase = "Running"
+	api.addPod(db)
+	startScheduler(t)
+
+	// The bound volume can only be used from zone b.
+	api.addPod(withClaim(newTestPod("job-zonal", "1", "1Gi"), "data-b"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-zonal") != "" }, "job-zonal was not bound")
+	if node := api.boundNode("default", "job-zonal"); node != "b-1" {
+		t.Errorf("expected job-zonal in zone b, got %s", node)
+	}
+
+	// The new volume can only be provisioned in zone a, and a-2 can't
+	// attach another one.
+	api.addPod(withClaim(newTestPod("job-new", "1", "1Gi"), "data-new"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-new") != "" }, "job-new was not bound")
+	if node := api.boundNode("default", "job-new"); node != "a-1" {
+		t.Errorf("expected job-new on a-1, got %s", node)
+	}
+	if node := api.claim("default", "data-new").Metadata.Annotations[selectedNodeAnnotation]; node != "a-1" {
+		t.Errorf("expected data-new provisioned for a-1, got %q", node)
+	}
+
+	api.addPod(withClaim(newTestPod("job-missing", "1", "1Gi"), "missing"))
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-missing", "FailedScheduling")) != 0 }, "no FailedScheduling event")
+	expected := `0/3 nodes are available: 3 persistentvolumeclaim "missing" not found.`
+	if note := api.eventsFor("job-missing", "FailedScheduling")[0].Note; note != expected {
+		t.Errorf("expected note %q, got %q", expected, note)
+	}
+}
+
+func TestLocalVolumes(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("n-1", "8", "16Gi", "100m", "1Gi")
+	api.addNode("n-2", "8", "16Gi", "4", "8Gi")
+
+	className := "local"
+	onNode := func(name, node, size string) PersistentVolume {
+		return PersistentVolume{
+			Metadata: Metadata{Name: name, ResourceVersion: "1"},
+			Spec: PersistentVolumeSpec{
+				StorageClassName: className,
+				Capacity:         ResourceList{"storage": size},
+				AccessModes:      []string{"ReadWriteOnce"},
+				NodeAffinity: &VolumeNodeAffinity{Required: &NodeSelector{NodeSelectorTerms: []NodeSelectorTerm{
+					{MatchFields: []NodeSelectorRequirement{{Key: "metadata.name", Operator: "In", Values: []string{node}}}},
+				}}},
+			},
+			Status: PersistentVolumeStatus{Phase: "Available"},
+		}
+	}
+	claim := func(name string) PersistentVolumeClaim {
+		return PersistentVolumeClaim{
+			Metadata: Metadata{Name: name, Namespace: "default", Uid: name + "-uid"},
+			Spec: PersistentVolumeClaimSpec{
+				StorageClassName: &className,
+				AccessModes:      []string{"ReadWriteOnce"},
+				Resources:        ResourceRequirements{Requests: ResourceList{"storage": "50Gi"}},
+			},
+		}
+	}
+	api.addVolumes(ClusterVolumes{
+		Claims:  []PersistentVolumeClaim{claim("data-1"), claim("data-2"), claim("data-3")},
+		Volumes: []PersistentVolume{onNode("pv-small", "n-1", "10Gi"), onNode("pv-1", "n-1", "100Gi"), onNode("pv-2", "n-2", "100Gi")},
+		Classes: []StorageClass{{Metadata: Metadata{Name: className}, Provisioner: noProvisioner, VolumeBindingMode: "WaitForFirstConsumer"}},
+	})
+	withClaim := func(pod *Pod, claim string) *Pod {
+		pod.Spec.Volumes = []Volume{{Name: "data", PersistentVolumeClaim: &PersistentVolumeClaimVolumeSource{ClaimName: claim}}}
+		return pod
+	}
+	startScheduler(t)
+
+	// The least used node has a large enough volume, the next pod gets the
+	// volume of the other node.
+	api.addPod(withClaim(newTestPod("job-1", "1", "1Gi"), "data-1"))
+	api.addPod(withClaim(newTestPod("job-2", "1", "1Gi"), "data-2"))
+	for name, node := range map[string]string{"job-1": "n-1", "job-2": "n-2"} {
+		name, node := name, node
+		eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", name) != "" }, "%s was not bound", name)
+		if bound := api.boundNode("default", name); bound != node {
+			t.Errorf("expected %s on %s, got %s", name, node, bound)
+		}
+	}
+	for claim, pv := range map[string]string{"data-1": "pv-1", "data-2": "pv-2"} {
+		if volume := api.claim("default", claim).Spec.VolumeName; volume != pv {
+			t.Errorf("expected %s bound to %s, got %q", claim, pv, volume)
+		}
+	}
+
+	api.addPod(withClaim(newTestPod("job-3", "1", "1Gi"), "data-3"))
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-3", "FailedScheduling")) != 0 }, "no FailedScheduling event")
+	expected := "0/2 nodes are available: 2 node(s) didn't find available persistent volumes to bind."
+	if note := api.eventsFor("job-3", "FailedScheduling")[0].Note; note != expected {
+		t.Errorf("expected note %q, got %q", expected, note)
+	}
+}
+
+func TestScheduleHostPorts(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("idle", "8", "16Gi", "100m", "1Gi")
+	api.addNode("busy", "8", "16Gi", "6", "12Gi")
+
+	withPort := func(pod *Pod, port ContainerPort) *Pod {
+		pod.Spec.Containers[0].Ports = []ContainerPort{port}
+		return pod
+	}
+	web := withPort(newTestPod("web", "1", "1Gi"), ContainerPort{ContainerPort: 80, HostPort: 8080})
+	web.Spec.NodeName = "idle"
+	web.Status.Phase = "Running"
+	api.addPod(web)
+	exporter := withPort(newTestPod("exporter", "100m", "100Mi"), ContainerPort{ContainerPort: 9100})
+	exporter.Spec.HostNetwork = true
+	exporter.Spec.NodeName = "busy"
+	exporter.Status.Phase = "Running"
+	api.addPod(exporter)
+	startScheduler(t)
+
+	expected := map[string]string{
+		// 8080/TCP is used on idle.
+		"job-tcp": "busy",
+		// Other protocols are free.
+		"job-udp": "idle",
+	}
+	api.addPod(withPort(newTestPod("job-tcp", "1", "1Gi"), ContainerPort{ContainerPort: 8080, HostPort: 8080, HostIP: "10.0.0.1"}))
+	api.addPod(withPort(newTestPod("job-udp", "1", "1Gi"), ContainerPort{ContainerPort: 8080, HostPort: 8080, Protocol: "UDP"}))
+	for name, node := range expected {
+		name, node := name, node
+		eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", name) != "" }, "%s was not bound", name)
+		if bound := api.boundNode("default", name); bound != node {
+			t.Errorf("expected %s on %s, got %s", name, node, bound)
+		}
+	}
+
+	// 9100 is used on busy by the host network, and 8080 on both nodes
+	// now.
+	api.addPod(withPort(newTestPod("job-both", "1", "1Gi"), ContainerPort{ContainerPort: 8080, HostPort: 8080}))
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-both", "FailedScheduling")) != 0 }, "no FailedScheduling event")
+	note := "0/2 nodes are available: 2 node(s) didn't have free ports for the requested pod ports."
+	if e := api.eventsFor("job-both", "FailedScheduling")[0]; e.Note != note {
+		t.Errorf("expected note %q, got %q", note, e.Note)
+	}
+	api.addPod(withPort(newTestPod("job-metrics", "1", "1Gi"), ContainerPort{ContainerPort: 9100, HostPort: 9100}))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-metrics") == "idle" }, "job-metrics was not bound to idle")
+}
+
+func TestSchedulingPolicies(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("spot-1", "8", "16Gi", "6", "12Gi").Metadata.Labels[nodePoolLabel] = "spot"
+	api.addNode("on-demand-1", "8", "16Gi", "100m", "1Gi").Metadata.Labels[nodePoolLabel] = "on-demand"
+	api.setPolicy(SchedulingPolicy{
+		Metadata: Metadata{Name: "defaults", Namespace: schedulerName},
+		Spec:     SchedulingPolicySpec{NodePools: []string{"spot"}},
+	})
+	api.setPolicy(SchedulingPolicy{
+		Metadata: Metadata{Name: "team-a", Namespace: "team-a"},
+		Spec:     SchedulingPolicySpec{NodePools: []string{"on-demand"}},
+	})
+	startScheduler(t, "--scheduling-policies", "--cluster-default-policy="+schedulerName+"/defaults")
+
+	inNamespace := func(pod *Pod, namespace string) *Pod {
+		pod.Metadata.Namespace = namespace
+		return pod
+	}
+	// team-b has no policy of its own, the cluster default applies.
+	api.addPod(inNamespace(newTestPod("job-b", "1", "1Gi"), "team-b"))
+	api.addPod(inNamespace(newTestPod("job-a", "1", "1Gi"), "team-a"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("team-b", "job-b") == "spot-1" }, "job-b was not bound to the spot pool")
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("team-a", "job-a") == "on-demand-1" }, "job-a was not bound to the on-demand pool")
+	api.updatePod("team-a", "job-a", func(pod *Pod) { pod.Status.Phase = "Running" })
+
+	// Policy changes are picked up by the watch.
+	limit := 1
+	api.setPolicy(SchedulingPolicy{
+		Metadata: Metadata{Name: "team-a", Namespace: "team-a"},
+		Spec:     SchedulingPolicySpec{NodePools: []string{"on-demand"}, MaxParallelJobs: &limit},
+	})
+	api.addPod(inNamespace(newTestPod("job-a2", "1", "1Gi"), "team-a"))
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-a2", "FailedScheduling")) != 0 }, "no FailedScheduling event")
+	expected := "0/2 nodes are available: 1 node(s) already running 1 jobs, 1 node(s) not in the allowed node pools."
+	if note := api.eventsFor("job-a2", "FailedScheduling")[0].Note; note != expected {
+		t.Errorf("expected note %q, got %q", expected, note)
+	}
+}
+
+func TestNodePools(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("spot-1", "4", "8Gi", "3", "6Gi").Metadata.Labels["lifecycle"] = "spot"
+	api.addNode("on-demand-1", "4", "8Gi", "100m", "1Gi").Metadata.Labels["lifecycle"] = "on-demand"
+
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(config, []byte(`apiVersion: k8s-resource-scheduler/v1alpha1
+kind: SchedulerConfiguration
+nodePools:
+- name: spot
+  selector:
+    matchLabels:
+      lifecycle: spot
+  overcommitRatio: 2
+  maxParallelJobs: 1
+- name: on-demand
+  selector:
+    matchExpressions:
+    - key: lifecycle
+      operator: NotIn
+      values: [spot]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startScheduler(t, "--config="+config)
+
+	preferSpot := func(pod *Pod) *Pod {
+		pod.Metadata.Annotations = map[string]string{schedulerName + "/node-pools": "spot, on-demand"}
+		return pod
+	}
+	// Only the overcommitted spot node fits the pod.
+	api.addPod(preferSpot(newTestPod("job-1", "6", "1Gi")))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-1") == "spot-1" }, "job-1 was not bound to the spot pool")
+	api.updatePod("default", "job-1", func(pod *Pod) { pod.Status.Phase = "Running" })
+
+	// The spot pool runs its maxParallelJobs, the pod falls back to on-demand.
+	api.addPod(preferSpot(newTestPod("job-2", "1", "1Gi")))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-2") == "on-demand-1" }, "job-2 did not fall back to the on-demand pool")
+}
+
+func TestUsageAdmission(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("dev-1", "4", "8Gi", "500m", "1Gi")
+	reserved := newTestPod("reserved", "4", "4Gi")
+	reserved.Spec.NodeName = "dev-1"
+	reserved.Status.Phase = "Running"
+	api.addPod(reserved)
+	api.setPolicy(SchedulingPolicy{
+		Metadata: Metadata{Name: "strict", Namespace: "strict"},
+		Spec:     SchedulingPolicySpec{Admission: admissionRequests},
+	})
+	startScheduler(t, "--admission-mode=usage", "--scheduling-policies")
+
+	// The node is fully requested, but barely used.
+	api.addPod(newTestPod("job-1", "1", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "job-1") == "dev-1" }, "job-1 was not bound")
+
+	// The usage of job-1 is assumed until the node metrics reflect it.
+	api.addPod(newTestPod("job-2", "2", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-2", "FailedScheduling")) != 0 }, "no FailedScheduling event for job-2")
+	expected := "0/1 nodes are available: 1 node(s) would exceed the cpu usage threshold."
+	if note := api.eventsFor("job-2", "FailedScheduling")[0].Note; note != expected {
+		t.Errorf("expected note %q, got %q", expected, note)
+	}
+
+	// The policy of the namespace admits its pods on their requests.
+	strict := newTestPod("job-3", "100m", "100Mi")
+	strict.Metadata.Namespace = "strict"
+	api.addPod(strict)
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-3", "FailedScheduling")) != 0 }, "no FailedScheduling event for job-3")
+	expected = "0/1 nodes are available: 1 Insufficient cpu."
+	if note := api.eventsFor("job-3", "FailedScheduling")[0].Note; note != expected {
+		t.Errorf("expected note %q, got %q", expected, note)
+	}
+}
+
+func TestUsageHistory(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("node-1", "4", "8Gi", "500m", "1Gi")
+	controller := true
+	replica := func(name, cpu string) *Pod {
+		pod := newTestPod(name, cpu, "1Gi")
+		pod.Metadata.Labels = map[string]string{"pod-template-hash": "5d4f8b7c9"}
+		pod.Metadata.OwnerReferences = []OwnerReference{{ApiVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-5d4f8b7c9", Controller: &controller}}
+		return pod
+	}
+	// A pod with unparsable metrics doesn't prevent learning the others.
+	broken := newTestPod("batch-x1", "1", "1Gi")
+	broken.Metadata.OwnerReferences = []OwnerReference{{ApiVersion: "batch/v1", Kind: "Job", Name: "batch", Controller: &controller}}
+	broken.Spec.NodeName = "node-1"
+	broken.Status.Phase = "Running"
+	api.addPod(broken)
+	api.setPodUsage("default", broken.Metadata.Name, "lots", "100Mi")
+	running := replica("web-5d4f8b7c9-x7k2p", "3")
+	running.Spec.NodeName = "node-1"
+	running.Status.Phase = "Running"
+	api.addPod(running)
+	api.setPodUsage("default", running.Metadata.Name, "200m", "100Mi")
+	startScheduler(t, "--admission-mode=usage", "--usage-history", "--usage-history-interval=50ms")
+
+	eventually(t, scheduleTimeout, func() bool {
+		_, _, ok := usageHistory.estimate(running, currentConfig().UsageHistory)
+		return ok
+	}, "the usage of the Deployment was not learnt")
+	if cpu, memory, _ := usageHistory.estimate(running, currentConfig().UsageHistory); cpu != 200 || memory != 100*1024*1024 {
+		t.Errorf("expected an estimated usage of 200m and 100Mi, got %dm and %d", cpu, memory)
+	}
+
+	// Its requests would exceed the cpu usage threshold.
+	api.addPod(replica("web-5d4f8b7c9-m9q4z", "3"))
+	eventually(t, scheduleTimeout, func() bool { return api.boundNode("default", "web-5d4f8b7c9-m9q4z") == "node-1" }, "the replica was not bound")
+
+	// Unknown workloads fall back to their requests.
+	api.addPod(newTestPod("job-1", "3", "1Gi"))
+	eventually(t, scheduleTimeout, func() bool { return len(api.eventsFor("job-1", "FailedScheduling")) != 0 }, "no FailedScheduling event for job-1")
+	expected := "0/1 nodes are available: 1 node(s) would exceed the cpu usage threshold."
+	if note := api.eventsFor("job-1", "FailedScheduling")[0].Note; note != expected {
+		t.Errorf("expected note %q, got %q", expected, note)
+	}
+}
+
+func TestUsageHistoryCronJobs(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("node-1", "4", "8Gi", "500m", "1Gi")
+	controller := true
+	jobPod := func(name, job string) *Pod {
+		pod := newTestPod(name, "1", "1Gi")
+		pod.Metadata.OwnerReferences = []OwnerReference{{ApiVersion: "batch/v1", Kind: "Job", Name: job, Controller: &controller}}
+		return pod
+	}
+	api.addJob("default", "report-28000000", "report")
+	api.addJob("default", "report-28000060", "report")
+	// Named as by a CronJob, but created by hand.
+	api.addJob("default", "migrate-28000000", "")
+	running := jobPod("report-28000000-x7k2p", "report-28000000")
+	running.Spec.NodeName = "node-1"
+	running.Status.Phase = "Running"
+	api.addPod(running)
+	api.setPodUsage("default", running.Metadata.Name, "200m", "100Mi")
+	// The next run of the CronJob is another Job, its pod is starting.
+	next := jobPod("report-28000060-m9q4z", "report-28000060")
+	next.Spec.NodeName = "node-1"
+	api.addPod(next)
+	migrate := jobPod("migrate-28000000-q2w3e", "migrate-28000000")
+	migrate.Spec.NodeName = "node-1"
+	api.addPod(migrate)
+	startScheduler(t, "--usage-history", "--usage-history-interval=50ms")
+
+	eventually(t, scheduleTimeout, func() bool {
+		_, _, ok := usageHistory.estimate(next, currentConfig().UsageHistory)
+		return ok
+	}, "the usage of the CronJob was not learnt")
+	if workload, _ := usageHistory.workloadOf(next); workload != "default/CronJob/report" {
+		t.Errorf("expected the pod to belong to the CronJob, got %s", workload)
+	}
+	if workload, _ := usageHistory.workloadOf(migrate); workload != "default/Job/migrate-28000000" {
+		t.Errorf("expected the pod to belong to the Job, got %s", workload)
+	}
+	// The Jobs are only fetched by the collection.
+	if _, resolved := usageHistory.workloadOf(jobPod("later-1-a1b2c", "later-1")); resolved {
+		t.Error("expected the Job of a pod not collected yet to be unresolved")
+	}
+}
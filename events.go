@@ -0,0 +1,135 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// maxEventNoteSize is the longest note the API accepts.
+	maxEventNoteSize = 1024
+	// eventSeriesWindow is how long an event can go without occurring
+	// before the next occurrence is a new event instead of a series.
+	eventSeriesWindow = 6 * time.Minute
+	// microTimeFormat is the format of the event times.
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var recorder = newEventRecorder()
+
+// eventRecorder writes events.k8s.io/v1 events. An event occurring again is
+// aggregated into the series of the first one, rather than posted again.
+type eventRecorder struct {
+	sync.Mutex
+	instance string
+	recent   map[eventKey]*recordedEvent
+}
+
+// eventKey identifies the occurrences of the same event.
+type eventKey struct {
+	controller string
+	regarding  ObjectReference
+	eventType  string
+	reason     string
+	action     string
+	note       string
+}
+
+type recordedEvent struct {
+	namespace, name string
+	count           int32
+	lastObserved    time.Time
+}
+
+func newEventRecorder() *eventRecorder {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &eventRecorder{instance: schedulerName + "-" + host, recent: map[eventKey]*recordedEvent{}}
+}
+
+// record posts an event about the regarding object, in its namespace, on
+// behalf of controller. If the same event was posted in the last
+// eventSeriesWindow, its series count is bumped instead.
+func (r *eventRecorder) record(controller string, regarding ObjectReference, eventType, reason, action, note string) error {
+	if len(note) > maxEventNoteSize {
+		note = note[:maxEventNoteSize-3] + "..."
+	}
+	now := time.Now()
+	key := eventKey{controller: controller, regarding: regarding, eventType: eventType, reason: reason, action: action, note: note}
+
+	r.Lock()
+	defer r.Unlock()
+	r.expire(now)
+
+	if e, ok := r.recent[key]; ok {
+		e.count++
+		e.lastObserved = now
+		err := patchEventSeries(e.namespace, e.name, EventSeries{Count: e.count, LastObservedTime: now.UTC().Format(microTimeFormat)})
+		if err != errEventGone {
+			return err
+		}
+		// The event expired in the API, start over.
+		delete(r.recent, key)
+	}
+
+	event := &Event{
+		ApiVersion: "events.k8s.io/v1",
+		Kind:       "Event",
+		Metadata: Metadata{
+			Name:      fmt.Sprintf("%s.%x", regarding.Name, now.UnixNano()),
+			Namespace: regarding.Namespace,
+		},
+		EventTime:           now.UTC().Format(microTimeFormat),
+		ReportingController: controller,
+		ReportingInstance:   r.instance,
+		Action:              action,
+		Reason:              reason,
+		Regarding:           regarding,
+		Note:                note,
+		Type:                eventType,
+	}
+	err := createEvent(event)
+	if err != nil {
+		return err
+	}
+	r.recent[key] = &recordedEvent{namespace: event.Metadata.Namespace, name: event.Metadata.Name, count: 1, lastObserved: now}
+	return nil
+}
+
+// expire forgets the events which didn't occur in the last
+// eventSeriesWindow.
+func (r *eventRecorder) expire(now time.Time) {
+	for key, e := range r.recent {
+		if now.Sub(e.lastObserved) > eventSeriesWindow {
+			delete(r.recent, key)
+		}
+	}
+}
+
+// objectReference returns a reference to the pod.
+func objectReference(pod *Pod) ObjectReference {
+	return ObjectReference{
+		ApiVersion: "v1",
+		Kind:       "Pod",
+		Name:       pod.Metadata.Name,
+		Namespace:  pod.Metadata.Namespace,
+		Uid:        pod.Metadata.Uid,
+	}
+}
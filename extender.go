@@ -0,0 +1,286 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// This file implements the kube-scheduler extender protocol
+// (k8s.io/kube-scheduler/extender/v1), so that the filter and score plugins
+// can run on top of a stock kube-scheduler.
+
+// maxExtenderPriority is the highest score kube-scheduler accepts from an
+// extender.
+const maxExtenderPriority = 10
+
+// ExtenderArgs are the arguments of the filter and prioritize verbs. Nodes
+// is set, unless the extender is nodeCacheCapable, in which case only
+// NodeNames is.
+type ExtenderArgs struct {
+	Pod       *Pod              `json:"pod"`
+	Nodes     *ExtenderNodeList `json:"nodes,omitempty"`
+	NodeNames *[]string         `json:"nodenames,omitempty"`
+}
+
+// ExtenderNodeList is a v1.NodeList. The nodes are kept as sent by
+// kube-scheduler, to be returned unchanged.
+type ExtenderNodeList struct {
+	Items []json.RawMessage `json:"items"`
+}
+
+// ExtenderFilterResult is the answer to the filter verb.
+type ExtenderFilterResult struct {
+	Nodes       *ExtenderNodeList `json:"nodes,omitempty"`
+	NodeNames   *[]string         `json:"nodenames,omitempty"`
+	FailedNodes map[string]string `json:"failedNodes,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// HostPriority is the score of a node, in the answer to the prioritize
+// verb.
+type HostPriority struct {
+	Host  string `json:"host"`
+	Score int64  `json:"score"`
+}
+
+// ExtenderBindingArgs are the arguments of the bind verb.
+type ExtenderBindingArgs struct {
+	PodName      string `json:"podName"`
+	PodNamespace string `json:"podNamespace"`
+	PodUID       string `json:"podUID"`
+	Node         string `json:"node"`
+}
+
+// ExtenderBindingResult is the answer to the bind verb.
+type ExtenderBindingResult struct {
+	Error string `json:"error,omitempty"`
+}
+
+// serveExtender serves the extender verbs on addr until done is closed.
+func serveExtender(addr string, done chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/filter", extenderHandler("filter", extenderFilter))
+	mux.HandleFunc("/prioritize", extenderHandler("prioritize", extenderPrioritize))
+	mux.HandleFunc("/bind", extenderHandler("bind", extenderBind))
+
+	logger.Info("Serving scheduler extender", "address", addr)
+	err := listenAndServe(&http.Server{Addr: addr, Handler: mux}, done)
+	if err != nil {
+		logger.Error("Extender server failed", "err", err)
+	}
+}
+
+// extenderHandler decodes the arguments of a verb, and encodes its answer.
+// Errors are answered with a 500, the verbs with an error field in their
+// answer report them there too.
+func extenderHandler(verb string, serve func(r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result := "success"
+		answer, err := serve(r)
+		if err != nil {
+			result = "error"
+			logger.Warn("Extender request failed", "verb", verb, "err", err)
+		}
+		extenderRequests.inc(verb, result)
+		extenderRequestDuration.since(start, verb)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if answer == nil {
+			answer = map[string]string{"error": err.Error()}
+		}
+		json.NewEncoder(w).Encode(answer)
+	}
+}
+
+// extenderFilter runs the filter plugins of the pod profile against the
+// nodes kube-scheduler found feasible.
+func extenderFilter(r *http.Request) (interface{}, error) {
+	args := &ExtenderArgs{}
+	err := json.NewDecoder(r.Body).Decode(args)
+	if err != nil {
+		return &ExtenderFilterResult{Error: err.Error()}, err
+	}
+	if args.Pod == nil {
+		err := errors.New("no pod to filter the nodes for")
+		return &ExtenderFilterResult{Error: err.Error()}, err
+	}
+
+	f := frameworkFor(args.Pod)
+	log := attemptLogger(args.Pod).With("profile", f.profile, "verb", "filter")
+	infos, given, failures, err := extenderNodeInfos(args)
+	if err != nil {
+		return &ExtenderFilterResult{Error: err.Error()}, err
+	}
+
+	feasible, rejected := f.filter(log, args.Pod, infos)
+	for node, reason := range rejected {
+		failures[node] = reason
+	}
+
+	answer := &ExtenderFilterResult{FailedNodes: failures}
+	if args.NodeNames != nil {
+		names := make([]string, 0, len(feasible))
+		for _, n := range feasible {
+			names = append(names, n.Name())
+		}
+		answer.NodeNames = &names
+	} else {
+		nodes := &ExtenderNodeList{Items: make([]json.RawMessage, 0, len(feasible))}
+		for _, n := range feasible {
+			nodes.Items = append(nodes.Items, given[n.Name()])
+		}
+		answer.Nodes = nodes
+	}
+	log.Debug("Extender filtered nodes", "feasible", len(feasible), "rejected", len(failures))
+	return answer, nil
+}
+
+// extenderPrioritize scores the nodes with the score plugins of the pod
+// profile, as bestNode does, scaled down to the extender range.
+func extenderPrioritize(r *http.Request) (interface{}, error) {
+	args := &ExtenderArgs{}
+	err := json.NewDecoder(r.Body).Decode(args)
+	if err != nil {
+		return nil, err
+	}
+	if args.Pod == nil {
+		return nil, errors.New("no pod to score the nodes for")
+	}
+
+	f := frameworkFor(args.Pod)
+	log := attemptLogger(args.Pod).With("profile", f.profile, "verb", "prioritize")
+	infos, _, unknown, err := extenderNodeInfos(args)
+	if err != nil {
+		return nil, err
+	}
+
+	priorities := make([]HostPriority, 0, len(infos)+len(unknown))
+	if len(infos) != 0 {
+		best, scores, err := bestNode(log, args.Pod, infos)
+		if err != nil {
+			return nil, err
+		}
+		max := f.maxScore(args.Pod, infos)
+		for _, s := range scores {
+			score := int64(0)
+			if max > 0 {
+				score = s.Score * maxExtenderPriority / max
+			}
+			priorities = append(priorities, HostPriority{Host: s.Node, Score: score})
+		}
+		log.Debug("Extender prioritized nodes", "best", best.Name())
+	}
+	for node := range unknown {
+		priorities = append(priorities, HostPriority{Host: node, Score: 0})
+	}
+	return priorities, nil
+}
+
+// extenderBind binds the pod, when the bind verb is enabled.
+func extenderBind(r *http.Request) (interface{}, error) {
+	args := &ExtenderBindingArgs{}
+	err := json.NewDecoder(r.Body).Decode(args)
+	if err != nil {
+		return &ExtenderBindingResult{Error: err.Error()}, err
+	}
+	if !currentConfig().Extender.Bind {
+		err := errors.New("the bind verb is disabled")
+		return &ExtenderBindingResult{Error: err.Error()}, err
+	}
+
+	// The scheduler name of the pod tells the profile the Scheduled event
+	// is reported by.
+	pod, err := getPod(args.PodNamespace, args.PodName)
+	if err == nil && pod == nil {
+		err = errPodGone
+	}
+	if err != nil {
+		return &ExtenderBindingResult{Error: err.Error()}, err
+	}
+	log := attemptLogger(pod).With("profile", frameworkFor(pod).profile, "verb", "bind")
+	err = bind(log, pod, &Node{Metadata: Metadata{Name: args.Node}})
+	if err != nil {
+		return &ExtenderBindingResult{Error: err.Error()}, err
+	}
+	return &ExtenderBindingResult{}, nil
+}
+
+// extenderNodeInfos returns the scheduler view of the nodes sent by
+// kube-scheduler, from the cached cluster state, and the nodes as sent by
+// name. Nodes missing from the cache, which is refreshed periodically, are
+// taken from the arguments without metrics when possible, and returned as
+// failures otherwise.
+func extenderNodeInfos(args *ExtenderArgs) ([]*NodeInfo, map[string]json.RawMessage, map[string]string, error) {
+	nodeList, podList, volumes, err := cache.snapshot()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cached := map[string]*Node{}
+	for _, n := range nodeList.Items {
+		cached[n.Metadata.Name] = n
+	}
+
+	names := []string{}
+	given := map[string]json.RawMessage{}
+	sent := map[string]*Node{}
+	if args.NodeNames != nil {
+		names = *args.NodeNames
+	} else if args.Nodes != nil {
+		for _, raw := range args.Nodes.Items {
+			n := &Node{}
+			err := json.Unmarshal(raw, n)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			names = append(names, n.Metadata.Name)
+			given[n.Metadata.Name] = raw
+			sent[n.Metadata.Name] = n
+		}
+	}
+
+	nodes := make([]*Node, 0, len(names))
+	unknown := map[string]string{}
+	for _, name := range names {
+		switch {
+		case cached[name] != nil:
+			nodes = append(nodes, cached[name])
+		case sent[name] != nil:
+			nodes = append(nodes, sent[name])
+		default:
+			unknown[name] = "node not in the " + schedulerName + " cache yet"
+		}
+	}
+
+	infos, err := newNodeInfos(nodes, withoutPod(podList.Items, args.Pod), volumes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return infos, given, unknown, nil
+}
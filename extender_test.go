@@ -0,0 +1,149 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startExtender syncs the cache from the fake API server and configures the
+// scheduler with the given flags.
+func startExtender(t *testing.T, args ...string) {
+	t.Helper()
+	cfg, err := parseConfig(append([]string{"--log-level=warn"}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache = &schedulerCache{}
+	policies = &policyStore{}
+	assumedUsage = &usageLedger{}
+	usageHistory = &usageHistoryStore{}
+	recorder = newEventRecorder()
+	err = cache.refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// callExtender posts args to the verb, and decodes the answer into answer.
+func callExtender(t *testing.T, verb string, args, answer interface{}) int {
+	t.Helper()
+	serve := map[string]func(r *http.Request) (interface{}, error){
+		"filter":     extenderFilter,
+		"prioritize": extenderPrioritize,
+		"bind":       extenderBind,
+	}[verb]
+
+	b, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	extenderHandler(verb, serve)(w, httptest.NewRequest(http.MethodPost, "/"+verb, bytes.NewReader(b)))
+	err = json.NewDecoder(w.Body).Decode(answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Code
+}
+
+func TestExtenderFilter(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("small", "1", "1Gi", "100m", "100Mi")
+	large := api.addNode("large", "8", "16Gi", "100m", "100Mi")
+	startExtender(t)
+	pod := newTestPod("job-1", "2", "1Gi")
+
+	// nodeCacheCapable: only the names are sent.
+	names := []string{"small", "large", "new"}
+	result := ExtenderFilterResult{}
+	if code := callExtender(t, "filter", ExtenderArgs{Pod: pod, NodeNames: &names}, &result); code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %+v", code, result)
+	}
+	if result.NodeNames == nil || len(*result.NodeNames) != 1 || (*result.NodeNames)[0] != "large" {
+		t.Errorf("expected only large to pass, got %+v", result)
+	}
+	if len(result.FailedNodes) != 2 || result.FailedNodes["small"] == "" || result.FailedNodes["new"] == "" {
+		t.Errorf("expected small and the unknown node to fail, got %v", result.FailedNodes)
+	}
+
+	// The nodes are sent, and returned unchanged.
+	raw, _ := json.Marshal(map[string]interface{}{"metadata": large.Metadata, "status": large.Status, "spec": map[string]bool{"unschedulable": false}})
+	small, _ := json.Marshal(map[string]interface{}{"metadata": Metadata{Name: "small"}})
+	result = ExtenderFilterResult{}
+	callExtender(t, "filter", ExtenderArgs{Pod: pod, Nodes: &ExtenderNodeList{Items: []json.RawMessage{small, raw}}}, &result)
+	if result.Nodes == nil || len(result.Nodes.Items) != 1 || !bytes.Equal(result.Nodes.Items[0], raw) {
+		t.Errorf("expected the large node as sent, got %+v", result.Nodes)
+	}
+}
+
+func TestExtenderPrioritize(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("busy", "4", "8Gi", "3", "6Gi")
+	api.addNode("idle", "4", "8Gi", "0", "0")
+	startExtender(t, "--score-plugins=LeastUsage=3")
+
+	names := []string{"busy", "idle"}
+	priorities := []HostPriority{}
+	callExtender(t, "prioritize", ExtenderArgs{Pod: newTestPod("job-1", "1", "1Gi"), NodeNames: &names}, &priorities)
+
+	// The requests of the pod count as its usage on both nodes.
+	expected := map[string]int64{"busy": 0, "idle": 8}
+	if len(priorities) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, priorities)
+	}
+	for _, p := range priorities {
+		if p.Score != expected[p.Host] {
+			t.Errorf("expected %s scored %d, got %d", p.Host, expected[p.Host], p.Score)
+		}
+	}
+}
+
+func TestExtenderBind(t *testing.T) {
+	api := startFakeAPIServer(t)
+	api.addNode("worker-1", "4", "8Gi", "0", "0")
+	pod := newTestPod("job-1", "1", "1Gi")
+	pod.Spec.SchedulerName = "batch"
+	api.addPod(pod)
+	args := ExtenderBindingArgs{PodName: "job-1", PodNamespace: "default", PodUID: "uid-1", Node: "worker-1"}
+
+	startExtender(t)
+	result := ExtenderBindingResult{}
+	if code := callExtender(t, "bind", args, &result); code == http.StatusOK || result.Error == "" {
+		t.Errorf("expected the bind verb to be disabled, got %d %+v", code, result)
+	}
+	if n := api.bindingCount("default", "job-1"); n != 0 {
+		t.Fatalf("expected no binding, got %d", n)
+	}
+
+	startExtender(t, "--extender-bind", "--scheduler-name="+schedulerName+",batch")
+	result = ExtenderBindingResult{}
+	if code := callExtender(t, "bind", args, &result); code != http.StatusOK || result.Error != "" {
+		t.Fatalf("unexpected bind answer %d %+v", code, result)
+	}
+	if node := api.boundNode("default", "job-1"); node != "worker-1" {
+		t.Errorf("expected job-1 bound to worker-1, got %q", node)
+	}
+	if events := api.eventsFor("job-1", "Scheduled"); len(events) != 1 || events[0].ReportingController != "batch" {
+		t.Errorf("expected one Scheduled event reported by the batch profile, got %+v", events)
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const maxNodeScore = 100
+
+// NodeInfo is the scheduler view of a node: the node itself, the pods bound
+// to it and the resources they request. Volumes is the storage state of the
+// cluster, the same for all the nodes, and Pool the node pool of the node.
+type NodeInfo struct {
+	Node            *Node
+	Pods            []*Pod
+	RequestedCPU    int64
+	RequestedMemory int64
+	Volumes         *VolumeState
+	Pool            *NodePool
+}
+
+func (n *NodeInfo) Name() string {
+	return n.Node.Metadata.Name
+}
+
+// FilterPlugin rejects the nodes a pod can not run on. Filter returns an
+// error describing why the pod does not fit the node, or nil.
+type FilterPlugin interface {
+	Name() string
+	Filter(pod *Pod, node *NodeInfo) error
+}
+
+// ScorePlugin ranks the nodes which passed the filters. Score returns a value
+// between 0 and maxNodeScore, the higher the better.
+type ScorePlugin interface {
+	Name() string
+	Score(pod *Pod, node *NodeInfo) (int64, error)
+}
+
+var filterPlugins = map[string]func(cfg *Config) FilterPlugin{}
+var scorePlugins = map[string]func(cfg *Config) ScorePlugin{}
+
+func registeredFilterPlugins() string {
+	names := []string{}
+	for n := range filterPlugins {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func registeredScorePlugins() string {
+	names := []string{}
+	for n := range scorePlugins {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// NodeScore is the weighted score of a node, and the score given to it by
+// each score plugin.
+type NodeScore struct {
+	Node    string           `json:"node"`
+	Score   int64            `json:"score"`
+	Plugins map[string]int64 `json:"plugins"`
+}
+
+type weightedScorePlugin struct {
+	ScorePlugin
+	weight int64
+}
+
+// framework runs the filter and score plugins of a profile against the nodes.
+type framework struct {
+	profile string
+	filters []FilterPlugin
+	scores  []weightedScorePlugin
+	// cfg builds the score plugins the policies add to the profile.
+	cfg *Config
+}
+
+func newFramework(cfg *Config, profile ProfileConfig) (*framework, error) {
+	f := &framework{profile: profile.SchedulerName, cfg: cfg}
+	for _, p := range profile.Plugins.Filter {
+		newPlugin, ok := filterPlugins[p.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown filter plugin %q", p.Name)
+		}
+		f.filters = append(f.filters, newPlugin(cfg))
+	}
+	for _, p := range profile.Plugins.Score {
+		newPlugin, ok := scorePlugins[p.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown score plugin %q", p.Name)
+		}
+		f.scores = append(f.scores, weightedScorePlugin{ScorePlugin: newPlugin(cfg), weight: p.Weight})
+	}
+	return f, nil
+}
+
+// frameworkFor returns the framework of the profile selected by the pod
+// spec.schedulerName. The pods of other schedulers, seen in shadow and
+// extender modes, fall back to the first profile.
+func frameworkFor(pod *Pod) *framework {
+	configLock.RLock()
+	defer configLock.RUnlock()
+
+	if f, ok := activeProfiles[pod.Spec.SchedulerName]; ok {
+		return f
+	}
+	return activeProfiles[activeConfig.Profiles[0].SchedulerName]
+}
+
+// filter returns the nodes which passed all the filter plugins, in the node
+// pool the pod prefers most, and the reason each of the other nodes was
+// rejected for.
+func (f *framework) filter(log *Logger, pod *Pod, nodes []*NodeInfo) ([]*NodeInfo, map[string]string) {
+	feasible := []*NodeInfo{}
+	failures := map[string]string{}
+
+NODES:
+	for _, n := range nodes {
+		for _, p := range f.filters {
+			err := p.Filter(pod, n)
+			if err != nil {
+				log.Debug("Node rejected", "node", n.Name(), "plugin", p.Name(), "reason", err)
+				failures[n.Name()] = p.Name() + ": " + err.Error()
+				continue NODES
+			}
+		}
+		feasible = append(feasible, n)
+	}
+	return preferNodePools(pod, feasible, failures), failures
+}
+
+// score returns the weighted sum of the scores given by each score plugin to
+// the nodes, in the same order.
+func (f *framework) score(log *Logger, pod *Pod, nodes []*NodeInfo) ([]NodeScore, error) {
+	scores := make([]NodeScore, len(nodes))
+	for i, n := range nodes {
+		scores[i] = NodeScore{Node: n.Name(), Plugins: map[string]int64{}}
+		for _, p := range f.scorePlugins(pod, n) {
+			s, err := p.Score(pod, n)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", p.Name(), err.Error())
+			}
+			log.Debug("Node scored", "node", n.Name(), "plugin", p.Name(), "score", s, "weight", p.weight)
+			scores[i].Plugins[p.Name()] = s
+			scores[i].Score += s * p.weight
+		}
+	}
+	return scores, nil
+}
+
+// scorePlugins returns the score plugins of the profile, with the weights
+// set by the node pool of the node, then by the policy of the pod. Plugins
+// with no weight are left out.
+func (f *framework) scorePlugins(pod *Pod, node *NodeInfo) []weightedScorePlugin {
+	weights := map[string]int64{}
+	if node.Pool != nil {
+		for name, w := range node.Pool.ScoreWeights {
+			weights[name] = w
+		}
+	}
+	for name, w := range policyFor(pod).weights {
+		weights[name] = w
+	}
+	if len(weights) == 0 {
+		return f.scores
+	}
+
+	plugins := []weightedScorePlugin{}
+	for _, p := range f.scores {
+		if w, ok := weights[p.Name()]; ok {
+			p.weight = w
+		}
+		if p.weight > 0 {
+			plugins = append(plugins, p)
+		}
+	}
+	names := []string{}
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if f.hasScorePlugin(name) || weights[name] == 0 {
+			continue
+		}
+		plugins = append(plugins, weightedScorePlugin{ScorePlugin: scorePlugins[name](f.cfg), weight: weights[name]})
+	}
+	return plugins
+}
+
+func (f *framework) hasScorePlugin(name string) bool {
+	for _, p := range f.scores {
+		if p.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// maxScore is the highest weighted score any of the nodes can get for the
+// pod.
+func (f *framework) maxScore(pod *Pod, nodes []*NodeInfo) int64 {
+	max := int64(0)
+	for _, n := range nodes {
+		nodeMax := int64(0)
+		for _, p := range f.scorePlugins(pod, n) {
+			nodeMax += p.weight * maxNodeScore
+		}
+		if nodeMax > max {
+			max = nodeMax
+		}
+	}
+	return max
+}
+
+// newNodeInfos groups the pods by the node they are bound to, and the nodes
+// by node pool.
+func newNodeInfos(nodes []*Node, pods []Pod, volumes *VolumeState) ([]*NodeInfo, error) {
+	infos := make([]*NodeInfo, 0, len(nodes))
+	byName := map[string]*NodeInfo{}
+	for _, n := range nodes {
+		info := &NodeInfo{Node: n, Volumes: volumes}
+		infos = append(infos, info)
+		byName[n.Metadata.Name] = info
+	}
+
+	for i := range pods {
+		p := &pods[i]
+		info, ok := byName[p.Spec.NodeName]
+		if !ok {
+			continue
+		}
+
+		cpu, memory, err := podRequests(p)
+		if err != nil {
+			return nil, err
+		}
+		info.Pods = append(info.Pods, p)
+		info.RequestedCPU += cpu
+		info.RequestedMemory += memory
+	}
+	setNodePools(currentConfig(), infos)
+	return infos, nil
+}
@@ -1,3 +1,5 @@
 module github.com/mudler/k8s-resource-scheduler
 
 go 1.15
+
+require gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,159 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var health = &healthState{}
+
+// elector is the leader elector, nil when leader election is disabled.
+var elector *leaderElector
+
+// healthState records the liveness signals of the scheduling loops.
+type healthState struct {
+	sync.Mutex
+	// processingSince is when the scheduling lock was taken, zero if it
+	// is not held.
+	processingSince time.Time
+	// watches holds when each running pods watch last received an event
+	// or bookmark, by watch id.
+	watches   map[int]time.Time
+	lastWatch int
+}
+
+func (h *healthState) setProcessing(processing bool) {
+	h.Lock()
+	defer h.Unlock()
+	if processing {
+		h.processingSince = time.Now()
+	} else {
+		h.processingSince = time.Time{}
+	}
+}
+
+// addWatch registers a running pods watch, and returns its id.
+func (h *healthState) addWatch() int {
+	h.Lock()
+	defer h.Unlock()
+	if h.watches == nil {
+		h.watches = map[int]time.Time{}
+	}
+	h.lastWatch++
+	h.watches[h.lastWatch] = time.Now()
+	return h.lastWatch
+}
+
+func (h *healthState) removeWatch(id int) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.watches, id)
+}
+
+func (h *healthState) watchEvent(id int) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.watches[id]; ok {
+		h.watches[id] = time.Now()
+	}
+}
+
+// livenessProblems returns the reasons the scheduler should be restarted.
+func (h *healthState) livenessProblems(cfg HealthConfig) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	problems := []string{}
+	now := time.Now()
+
+	if t := cfg.SchedulingTimeout.Duration; t > 0 && !h.processingSince.IsZero() && now.Sub(h.processingSince) > t {
+		problems = append(problems, fmt.Sprintf("scheduling loop stuck for %s", now.Sub(h.processingSince).Round(time.Second)))
+	}
+
+	if t := cfg.WatchTimeout.Duration; t > 0 {
+		// A single stuck watch, for one scheduler name, is enough.
+		var oldest time.Time
+		for _, last := range h.watches {
+			if oldest.IsZero() || last.Before(oldest) {
+				oldest = last
+			}
+		}
+		if !oldest.IsZero() && now.Sub(oldest) > t {
+			problems = append(problems, fmt.Sprintf("no watch events or bookmarks for %s", now.Sub(oldest).Round(time.Second)))
+		}
+	}
+
+	if t := cfg.MetricsTimeout.Duration; t > 0 {
+		ages := nodeMetricsAges()
+		if len(ages) != 0 {
+			freshest := -1.0
+			for _, age := range ages {
+				if freshest < 0 || age < freshest {
+					freshest = age
+				}
+			}
+			if freshest > t.Seconds() {
+				problems = append(problems, fmt.Sprintf("node metrics stale for %s", (time.Duration(freshest)*time.Second).Round(time.Second)))
+			}
+		}
+	}
+
+	return problems
+}
+
+// readinessProblems returns the reasons the scheduler is not ready to
+// schedule pods: the cluster state is not synced, or, when leader election
+// is enabled and health.readinessRequiresLeader set, it is a standby.
+func readinessProblems(cfg HealthConfig) []string {
+	problems := []string{}
+	if !cache.synced() {
+		problems = append(problems, "cluster state not synced")
+	}
+	if cfg.ReadinessRequiresLeader && !leading() {
+		problems = append(problems, "not the leader")
+	}
+	return problems
+}
+
+// leaderHandler answers ok when this replica may bind pods, else 503.
+func leaderHandler(w http.ResponseWriter, r *http.Request) {
+	problems := []string{}
+	if !leading() {
+		problems = append(problems, "not the leader")
+	}
+	writeProblems(w, problems)
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblems(w, health.livenessProblems(currentConfig().Health))
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblems(w, readinessProblems(currentConfig().Health))
+}
+
+func writeProblems(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain")
+	if len(problems) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
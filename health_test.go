@@ -0,0 +1,43 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLivenessWatches(t *testing.T) {
+	cfg := HealthConfig{WatchTimeout: Duration{time.Minute}}
+	h := &healthState{}
+	if problems := h.livenessProblems(cfg); len(problems) != 0 {
+		t.Fatalf("expected no problems without watches, got %v", problems)
+	}
+
+	stuck := h.addWatch()
+	busy := h.addWatch()
+	h.Lock()
+	h.watches[stuck] = time.Now().Add(-2 * time.Minute)
+	h.Unlock()
+	h.watchEvent(busy)
+	if problems := h.livenessProblems(cfg); len(problems) != 1 || problems[0] != "no watch events or bookmarks for 2m0s" {
+		t.Fatalf("expected the stuck watch to be reported, got %v", problems)
+	}
+
+	h.removeWatch(stuck)
+	h.watchEvent(stuck)
+	if problems := h.livenessProblems(cfg); len(problems) != 0 {
+		t.Fatalf("expected no problems once the stuck watch stopped, got %v", problems)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var usageHistory = &usageHistoryStore{}
+
+// usageHistoryStore holds the most recent usage samples of the workloads,
+// collected from the metrics of their pods.
+type usageHistoryStore struct {
+	sync.RWMutex
+	byWorkload map[string]*workloadUsage
+	// cronJobs caches the owner of the Jobs of the pods, by namespace/name.
+	cronJobs map[string]jobOwner
+}
+
+// jobOwner is the CronJob controlling a Job, "" for the Jobs without.
+type jobOwner struct {
+	cronJob string
+	// failed is when fetching the Job failed, it is fetched again after
+	// jobRetryInterval.
+	failed time.Time
+}
+
+const jobRetryInterval = 5 * time.Minute
+
+type workloadUsage struct {
+	// cpu (in millicores) and memory (in bytes) samples, oldest first.
+	cpu, memory []int64
+	lastSample  time.Time
+}
+
+// workloadOf returns the workload owning the pod, as namespace/Kind/name, or
+// "" for the pods without controller. The pods of a ReplicaSet belong to its
+// Deployment, and the pods of a Job controlled by a CronJob to the CronJob.
+// It returns false for the pods of a Job collect has not resolved yet.
+func (h *usageHistoryStore) workloadOf(pod *Pod) (string, bool) {
+	for _, o := range pod.Metadata.OwnerReferences {
+		if o.Controller == nil || !*o.Controller {
+			continue
+		}
+
+		kind, name := o.Kind, o.Name
+		hash := pod.Metadata.Labels["pod-template-hash"]
+		switch {
+		case kind == "ReplicaSet" && hash != "" && strings.HasSuffix(name, "-"+hash):
+			kind, name = "Deployment", strings.TrimSuffix(name, "-"+hash)
+		case kind == "Job":
+			h.RLock()
+			owner, ok := h.cronJobs[pod.Metadata.Namespace+"/"+name]
+			h.RUnlock()
+			if !ok || !owner.failed.IsZero() {
+				return "", false
+			}
+			if owner.cronJob != "" {
+				kind, name = "CronJob", owner.cronJob
+			}
+		}
+		return pod.Metadata.Namespace + "/" + kind + "/" + name, true
+	}
+	return "", true
+}
+
+// resolveJobs fetches the Jobs, by namespace/name, whose owner is not known
+// yet, or failed to be fetched more than jobRetryInterval ago.
+func (h *usageHistoryStore) resolveJobs(jobs map[string]bool) {
+	for key := range jobs {
+		h.RLock()
+		owner, ok := h.cronJobs[key]
+		h.RUnlock()
+		if ok && (owner.failed.IsZero() || time.Since(owner.failed) < jobRetryInterval) {
+			continue
+		}
+
+		owner = jobOwner{}
+		parts := strings.SplitN(key, "/", 2)
+		j, err := getJob(parts[0], parts[1])
+		switch {
+		case err != nil:
+			logger.Warn("Failed getting the Job of a pod", "job", key, "err", err)
+			owner.failed = time.Now()
+		case j != nil:
+			for _, o := range j.Metadata.OwnerReferences {
+				if o.Kind == "CronJob" && o.Controller != nil && *o.Controller {
+					owner.cronJob = o.Name
+				}
+			}
+		}
+
+		h.Lock()
+		if h.cronJobs == nil {
+			h.cronJobs = map[string]jobOwner{}
+		}
+		h.cronJobs[key] = owner
+		h.Unlock()
+	}
+}
+
+// add records a usage sample of the workload, keeping the maxSamples most
+// recent ones.
+func (h *usageHistoryStore) add(workload string, cpu, memory int64, at time.Time, maxSamples int) {
+	h.Lock()
+	defer h.Unlock()
+	if h.byWorkload == nil {
+		h.byWorkload = map[string]*workloadUsage{}
+	}
+	w, ok := h.byWorkload[workload]
+	if !ok {
+		w = &workloadUsage{}
+		h.byWorkload[workload] = w
+	}
+	w.cpu = append(w.cpu, cpu)
+	w.memory = append(w.memory, memory)
+	if extra := len(w.cpu) - maxSamples; extra > 0 {
+		w.cpu = append([]int64(nil), w.cpu[extra:]...)
+		w.memory = append([]int64(nil), w.memory[extra:]...)
+	}
+	w.lastSample = at
+}
+
+// expire forgets the workloads without samples since retention, and the
+// Jobs no pod belongs to anymore.
+func (h *usageHistoryStore) expire(retention time.Duration, jobs map[string]bool) {
+	h.Lock()
+	defer h.Unlock()
+	for name, w := range h.byWorkload {
+		if time.Since(w.lastSample) > retention {
+			delete(h.byWorkload, name)
+		}
+	}
+	for job := range h.cronJobs {
+		if !jobs[job] {
+			delete(h.cronJobs, job)
+		}
+	}
+}
+
+// estimate returns the percentile of the CPU and memory samples of the
+// workload of the pod, and false when the workload has less than
+// minSamples samples.
+func (h *usageHistoryStore) estimate(pod *Pod, cfg UsageHistoryConfig) (int64, int64, bool) {
+	workload, resolved := h.workloadOf(pod)
+	if !resolved {
+		logger.Debug("Job of the pod not resolved yet, no usage estimate", "pod", pod.Metadata.Namespace+"/"+pod.Metadata.Name)
+		return 0, 0, false
+	}
+	if workload == "" {
+		return 0, 0, false
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+	w, ok := h.byWorkload[workload]
+	if !ok || len(w.cpu) < cfg.MinSamples {
+		return 0, 0, false
+	}
+	return percentile(w.cpu, cfg.Percentile), percentile(w.memory, cfg.Percentile), true
+}
+
+// percentile returns the nearest rank p percentile of the samples.
+func percentile(samples []int64, p float64) int64 {
+	sorted := append([]int64(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// collect samples the usage of the running pods owned by a workload, from
+// the pod metrics.
+func (h *usageHistoryStore) collect() error {
+	cfg := currentConfig().UsageHistory
+	_, podList, _, err := cache.snapshot()
+	if err != nil {
+		return err
+	}
+	pods := map[string]*Pod{}
+	jobs := map[string]bool{}
+	for i := range podList.Items {
+		p := &podList.Items[i]
+		pods[p.Metadata.Namespace+"/"+p.Metadata.Name] = p
+		for _, o := range p.Metadata.OwnerReferences {
+			if o.Kind == "Job" {
+				jobs[p.Metadata.Namespace+"/"+o.Name] = true
+			}
+		}
+	}
+	h.resolveJobs(jobs)
+
+	var metrics PodMetricsList
+	err = getList(podMetricsEndpoint, &metrics)
+	if err != nil {
+		return err
+	}
+
+	sampled := 0
+	for _, m := range metrics.Items {
+		pod, ok := pods[m.Metadata.Namespace+"/"+m.Metadata.Name]
+		if !ok {
+			continue
+		}
+		workload, _ := h.workloadOf(pod)
+		if workload == "" {
+			// Without controller, or its Job failed to be fetched.
+			continue
+		}
+
+		cpu, memory, err := podUsage(m)
+		if err != nil {
+			logger.Warn("Failed parsing pod usage, skipped", "pod", m.Metadata.Namespace+"/"+m.Metadata.Name, "err", err)
+			continue
+		}
+		h.add(workload, cpu, memory, time.Now(), cfg.MaxSamples)
+		sampled++
+	}
+	h.expire(cfg.Retention.Duration, jobs)
+	logger.Debug("Collected pod usage", "pods", sampled)
+	return nil
+}
+
+// podUsage returns the CPU (in millicores) and memory (in bytes) used by the
+// containers of the pod.
+func podUsage(m PodMetrics) (cpu, memory int64, err error) {
+	for _, c := range m.Containers {
+		containerCPU, err := milliCPU(c.Usage.Cpu)
+		if err != nil {
+			return 0, 0, err
+		}
+		containerMemory, err := memoryBytes(c.Usage.Memory)
+		if err != nil {
+			return 0, 0, err
+		}
+		cpu += containerCPU
+		memory += containerMemory
+	}
+	return cpu, memory, nil
+}
+
+func (h *usageHistoryStore) run(interval time.Duration, done chan struct{}, wg *sync.WaitGroup) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-done:
+			wg.Done()
+			logger.Info("Stopped usage history collection")
+			return
+		}
+
+		err := h.collect()
+		if err != nil {
+			logger.Warn("Failed collecting pod usage", "err", err)
+		}
+	}
+}
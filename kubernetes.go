@@ -16,29 +16,53 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"strconv"
+	"sort"
 	"strings"
 	"time"
 )
 
+// HTTPClient sends the requests to the Kubernetes API.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// apiClient is the HTTPClient used for all the requests to apiHost.
+var apiClient HTTPClient = http.DefaultClient
+
 var (
-	apiHost           = "127.0.0.1:8001"
-	bindingsEndpoint  = "/api/v1/namespaces/%s/pods/%s/binding/"
-	eventsEndpoint    = "/api/v1/namespaces/%s/events"
-	nodesEndpoint     = "/api/v1/nodes"
-	podsEndpoint      = "/api/v1/pods"
-	watchPodsEndpoint = "/api/v1/watch/pods"
-	metricsEndpoint   = "/apis/metrics.k8s.io/v1beta1/nodes/%s"
+	apiHost            = "127.0.0.1:8001"
+	bindingsEndpoint   = "/api/v1/namespaces/%s/pods/%s/binding/"
+	eventsEndpoint     = "/apis/events.k8s.io/v1/namespaces/%s/events"
+	eventEndpoint      = "/apis/events.k8s.io/v1/namespaces/%s/events/%s"
+	nodesEndpoint      = "/api/v1/nodes"
+	podsEndpoint       = "/api/v1/pods"
+	podEndpoint        = "/api/v1/namespaces/%s/pods/%s"
+	podStatusEndpoint  = "/api/v1/namespaces/%s/pods/%s/status"
+	watchPodsEndpoint  = "/api/v1/watch/pods"
+	watchConfigMaps    = "/api/v1/watch/namespaces/%s/configmaps"
+	metricsEndpoint    = "/apis/metrics.k8s.io/v1beta1/nodes/%s"
+	podMetricsEndpoint = "/apis/metrics.k8s.io/v1beta1/pods"
+	jobEndpoint        = "/apis/batch/v1/namespaces/%s/jobs/%s"
+	leasesEndpoint     = "/apis/coordination.k8s.io/v1/namespaces/%s/leases"
+	leaseEndpoint      = "/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s"
+	claimsEndpoint     = "/api/v1/persistentvolumeclaims"
+	claimEndpoint      = "/api/v1/namespaces/%s/persistentvolumeclaims/%s"
+	volumesEndpoint    = "/api/v1/persistentvolumes"
+	volumeEndpoint     = "/api/v1/persistentvolumes/%s"
+	classesEndpoint    = "/apis/storage.k8s.io/v1/storageclasses"
+	csiNodesEndpoint   = "/apis/storage.k8s.io/v1/csinodes"
+	policiesEndpoint   = "/apis/scheduling.k8s-resource-scheduler.io/v1alpha1/schedulingpolicies"
 )
 
-func postEvent(event Event) error {
+func createEvent(event *Event) error {
 	var b []byte
 	body := bytes.NewBuffer(b)
 	err := json.NewEncoder(body).Encode(event)
@@ -53,24 +77,63 @@ func postEvent(event Event) error {
 		Method:        http.MethodPost,
 		URL: &url.URL{
 			Host:   apiHost,
-			Path:   fmt.Sprintf(eventsEndpoint, event.Namespace),
+			Path:   fmt.Sprintf(eventsEndpoint, event.Metadata.Namespace),
 			Scheme: "http",
 		},
 	}
 	request.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := apiClient.Do(request)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 201 {
 		b, _ := ioutil.ReadAll(resp.Body)
-		log.Println(string(b))
-		return errors.New("Event: Unexpected HTTP status code" + resp.Status)
+		return errors.New("Event: Unexpected HTTP status code" + resp.Status + string(b))
 	}
 	return nil
 }
 
+// errEventGone is returned when patching an event which expired.
+var errEventGone = errors.New("event not found")
+
+// patchEventSeries updates the series of an event.
+func patchEventSeries(namespace, name string, series EventSeries) error {
+	b, err := json.Marshal(map[string]interface{}{"series": series})
+	if err != nil {
+		return err
+	}
+
+	request := &http.Request{
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Header:        make(http.Header),
+		Method:        http.MethodPatch,
+		URL: &url.URL{
+			Host:   apiHost,
+			Path:   fmt.Sprintf(eventEndpoint, namespace, name),
+			Scheme: "http",
+		},
+	}
+	request.Header.Set("Content-Type", "application/merge-patch+json")
+
+	resp, err := apiClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errEventGone
+	default:
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("Event: Unexpected HTTP status code" + resp.Status + string(b))
+	}
+}
+
 func getNodes() (*NodeList, error) {
 	nodeList := &NodeList{}
 
@@ -85,7 +148,7 @@ func getNodes() (*NodeList, error) {
 	}
 	request.Header.Set("Accept", "application/json, */*")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := apiClient.Do(request)
 	if err != nil {
 		return nodeList, err
 	}
@@ -97,16 +160,15 @@ func getNodes() (*NodeList, error) {
 	result := &NodeList{ApiVersion: nodeList.ApiVersion, Kind: nodeList.Kind, Items: []*Node{}}
 NODE:
 	for _, n := range nodeList.Items {
-	COND:
-		for _, c := range n.Status.Conditions {
-			if c.Type == "Ready" && c.Status == "True" {
-				result.Items = append(result.Items, n)
-				log.Println("Node up", n.Metadata.Name)
-				break COND
-			}
+		result.Items = append(result.Items, n)
+		if !nodeReady(n) {
+			// Rejected by the NodeReady filter, its metrics are not
+			// needed.
+			logger.Debug("Node not ready", "node", n.Metadata.Name)
+			continue NODE
 		}
+		logger.Debug("Node ready", "node", n.Metadata.Name)
 
-		log.Println("Gathering metrics for", fmt.Sprintf(metricsEndpoint, n.Metadata.Name))
 		var nm NodeMetrics
 		request := &http.Request{
 			Header: make(http.Header),
@@ -119,37 +181,91 @@ NODE:
 		}
 		request.Header.Set("Accept", "application/json, */*")
 
-		resp, err := http.DefaultClient.Do(request)
+		resp, err := apiClient.Do(request)
 		if err != nil {
-			log.Println("Failed getting metrics", err)
+			logger.Warn("Failed getting node metrics", "node", n.Metadata.Name, "err", err)
 			continue NODE
 		}
 
 		if resp.StatusCode != 200 {
 			b, _ := ioutil.ReadAll(resp.Body)
-			log.Println(string(b))
+			logger.Warn("Failed getting node metrics", "node", n.Metadata.Name, "status", resp.Status, "body", string(b))
 			continue NODE
 		}
 
 		err = json.NewDecoder(resp.Body).Decode(&nm)
 		if err != nil {
-			log.Println("Failed getting metrics", err)
+			logger.Warn("Failed getting node metrics", "node", n.Metadata.Name, "err", err)
 			continue NODE
 		}
 
 		n.NodeMetrics = nm
-		log.Println("CPU/RAM Usage:", n.NodeMetrics.Usage.Cpu, n.NodeMetrics.Usage.Memory)
+		logger.Debug("Node usage", "node", n.Metadata.Name, "cpu", n.NodeMetrics.Usage.Cpu, "memory", n.NodeMetrics.Usage.Memory)
 	}
 	return result, nil
 }
 
-func watchUnscheduledPods() (<-chan Pod, <-chan error) {
-	pods := make(chan Pod)
+func nodeReady(n *Node) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == "Ready" {
+			return c.Status == "True"
+		}
+	}
+	return false
+}
+
+// unscheduledSelector selects the unscheduled pods of a scheduler name.
+func unscheduledSelector(name string) string {
+	return "spec.nodeName=,spec.schedulerName=" + name
+}
+
+// watchUnscheduledPods streams the events of the unscheduled pods of the
+// scheduler names until done is closed, with one watch per name. Pods which
+// get bound no longer match the watch, and are streamed as DELETED.
+func watchUnscheduledPods(names []string, done chan struct{}) (<-chan PodWatchEvent, <-chan error) {
+	events := make(chan PodWatchEvent)
+	errc := make(chan error, 1)
+
+	for _, name := range names {
+		nameEvents, nameErrc := watchPods(unscheduledSelector(name), done)
+		go func() {
+			for {
+				select {
+				case event := <-nameEvents:
+					select {
+					case events <- event:
+					case <-done:
+						return
+					}
+				case err := <-nameErrc:
+					select {
+					case errc <- err:
+					default:
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return events, errc
+}
+
+// watchPods streams the events of the pods matching the field selector until
+// done is closed. The watch is restarted when it fails, which replays the
+// existing pods as ADDED events.
+func watchPods(fieldSelector string, done chan struct{}) (<-chan PodWatchEvent, <-chan error) {
+	events := make(chan PodWatchEvent)
 	errc := make(chan error, 1)
 
 	v := url.Values{}
-	v.Set("fieldSelector", "spec.nodeName=")
+	if fieldSelector != "" {
+		v.Set("fieldSelector", fieldSelector)
+	}
+	v.Set("allowWatchBookmarks", "true")
 
+	ctx, cancel := context.WithCancel(context.Background())
 	request := &http.Request{
 		Header: make(http.Header),
 		Method: http.MethodGet,
@@ -161,84 +277,261 @@ func watchUnscheduledPods() (<-chan Pod, <-chan error) {
 		},
 	}
 	request.Header.Set("Accept", "application/json, */*")
+	request = request.WithContext(ctx)
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	report := func(err error) {
+		select {
+		case <-done:
+			// The watch was cancelled.
+			return
+		default:
+		}
+		select {
+		case errc <- err:
+		default:
+		}
+	}
 
 	go func() {
+		id := health.addWatch()
+		defer health.removeWatch(id)
 		for {
-			resp, err := http.DefaultClient.Do(request)
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			resp, err := apiClient.Do(request)
 			if err != nil {
-				errc <- err
+				report(err)
 				time.Sleep(5 * time.Second)
 				continue
 			}
 
 			if resp.StatusCode != 200 {
 				b, _ := ioutil.ReadAll(resp.Body)
-				errc <- errors.New("Invalid status code: " + resp.Status + string(b))
+				resp.Body.Close()
+				report(errors.New("Invalid status code: " + resp.Status + string(b)))
 				time.Sleep(5 * time.Second)
 				continue
 			}
 
+			health.watchEvent(id)
 			decoder := json.NewDecoder(resp.Body)
 			for {
 				var event PodWatchEvent
 				err = decoder.Decode(&event)
 				if err != nil {
-					errc <- err
+					report(err)
 					break
 				}
+				health.watchEvent(id)
 
-				if event.Type == "ADDED" {
-					pods <- event.Object
+				if event.Type == "BOOKMARK" {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-done:
 				}
 			}
+			resp.Body.Close()
 		}
 	}()
 
-	return pods, errc
+	return events, errc
 }
 
-func getUnscheduledPods() ([]*Pod, error) {
-	var podList PodList
-	unscheduledPods := make([]*Pod, 0)
+// watchConfigMap streams the changes of a ConfigMap until done is closed.
+func watchConfigMap(namespace, name string, done chan struct{}) (<-chan ConfigMap, <-chan error) {
+	configMaps := make(chan ConfigMap)
+	errc := make(chan error, 1)
 
 	v := url.Values{}
-	v.Set("fieldSelector", "spec.nodeName=")
+	v.Set("fieldSelector", "metadata.name="+name)
 
+	ctx, cancel := context.WithCancel(context.Background())
 	request := &http.Request{
 		Header: make(http.Header),
 		Method: http.MethodGet,
 		URL: &url.URL{
 			Host:     apiHost,
-			Path:     podsEndpoint,
+			Path:     fmt.Sprintf(watchConfigMaps, namespace),
 			RawQuery: v.Encode(),
 			Scheme:   "http",
 		},
 	}
 	request.Header.Set("Accept", "application/json, */*")
+	request = request.WithContext(ctx)
+
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	report := func(err error) {
+		select {
+		case <-done:
+			// The watch was cancelled.
+			return
+		default:
+		}
+		select {
+		case errc <- err:
+		default:
+		}
+	}
+
+	go func() {
+		id := health.addWatch()
+		defer health.removeWatch(id)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			resp, err := apiClient.Do(request)
+			if err != nil {
+				report(err)
+				time.Sleep(5 * time.Second)
+				continue
+			}
+
+			if resp.StatusCode != 200 {
+				b, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				report(errors.New("Invalid status code: " + resp.Status + string(b)))
+				time.Sleep(5 * time.Second)
+				continue
+			}
 
-	resp, err := http.DefaultClient.Do(request)
+			decoder := json.NewDecoder(resp.Body)
+			for {
+				var event ConfigMapWatchEvent
+				err = decoder.Decode(&event)
+				if err != nil {
+					report(err)
+					break
+				}
+
+				if event.Type == "ADDED" || event.Type == "MODIFIED" {
+					select {
+					case configMaps <- event.Object:
+					case <-done:
+					}
+				}
+			}
+			resp.Body.Close()
+		}
+	}()
+
+	return configMaps, errc
+}
+
+func listSchedulingPolicies() (*SchedulingPolicyList, error) {
+	list := &SchedulingPolicyList{}
+	err := getList(policiesEndpoint, list)
 	if err != nil {
-		return unscheduledPods, err
+		return nil, err
 	}
-	err = json.NewDecoder(resp.Body).Decode(&podList)
+	return list, nil
+}
+
+// watchSchedulingPolicies calls apply with the changes of the
+// SchedulingPolicies since resourceVersion, until the watch ends or done is
+// closed.
+func watchSchedulingPolicies(resourceVersion string, done chan struct{}, apply func(SchedulingPolicyWatchEvent)) error {
+	v := url.Values{}
+	v.Set("watch", "true")
+	v.Set("resourceVersion", resourceVersion)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Host:     apiHost,
+			Path:     policiesEndpoint,
+			RawQuery: v.Encode(),
+			Scheme:   "http",
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+	request = request.WithContext(ctx)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-finished:
+		}
+	}()
+
+	resp, err := apiClient.Do(request)
 	if err != nil {
-		return unscheduledPods, err
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("Invalid status code: " + resp.Status + string(b))
 	}
 
-	for _, pod := range podList.Items {
-		if pod.Metadata.Annotations["scheduler.alpha.kubernetes.io/name"] == schedulerName {
-			unscheduledPods = append(unscheduledPods, &pod)
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event SchedulingPolicyWatchEvent
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			// The API server ends the watches after a while.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if event.Type == "ERROR" {
+			// Typically, the version listed is too old.
+			return errors.New("watch error event")
 		}
+		apply(event)
 	}
+}
 
+// getUnscheduledPods lists the unscheduled pods of our profiles.
+func getUnscheduledPods() ([]*Pod, error) {
+	cfg := currentConfig()
+	unscheduledPods := make([]*Pod, 0)
+	for _, name := range cfg.schedulerNames() {
+		pods, err := listUnscheduledPods(name)
+		if err != nil {
+			return unscheduledPods, err
+		}
+		for _, pod := range pods {
+			if cfg.ownsPod(pod) {
+				unscheduledPods = append(unscheduledPods, pod)
+			}
+		}
+	}
 	return unscheduledPods, nil
 }
 
-func getRunningPods() (pods []Pod, err error) {
+// listUnscheduledPods lists the unscheduled pods of a scheduler name.
+func listUnscheduledPods(name string) ([]*Pod, error) {
 	var podList PodList
+	unscheduledPods := make([]*Pod, 0)
 
 	v := url.Values{}
-	v.Add("fieldSelector", "status.phase=Running")
+	v.Set("fieldSelector", unscheduledSelector(name))
 
 	request := &http.Request{
 		Header: make(http.Header),
@@ -252,28 +545,27 @@ func getRunningPods() (pods []Pod, err error) {
 	}
 	request.Header.Set("Accept", "application/json, */*")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := apiClient.Do(request)
 	if err != nil {
-		return nil, err
+		return unscheduledPods, err
 	}
 	err = json.NewDecoder(resp.Body).Decode(&podList)
 	if err != nil {
-		return nil, err
+		return unscheduledPods, err
 	}
 
-	for _, p := range podList.Items {
-		if p.Spec.SchedulerName == schedulerName {
-			pods = append(pods, p)
-		}
+	for i := range podList.Items {
+		unscheduledPods = append(unscheduledPods, &podList.Items[i])
 	}
-	return
+
+	return unscheduledPods, nil
 }
+
 func getPods() (*PodList, error) {
 	var podList PodList
 
 	v := url.Values{}
-	v.Add("fieldSelector", "status.phase=Running")
-	v.Add("fieldSelector", "status.phase=Pending")
+	v.Set("fieldSelector", "status.phase!=Succeeded,status.phase!=Failed")
 
 	request := &http.Request{
 		Header: make(http.Header),
@@ -287,7 +579,7 @@ func getPods() (*PodList, error) {
 	}
 	request.Header.Set("Accept", "application/json, */*")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := apiClient.Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -298,114 +590,261 @@ func getPods() (*PodList, error) {
 	return &podList, nil
 }
 
-type ResourceUsage struct {
-	CPU int
-}
-
-func fit(pod *Pod) ([]Node, error) {
-	nodeList, err := getNodes()
+// getVolumes lists the storage objects the volume plugins depend on.
+func getVolumes() (*ClusterVolumes, error) {
+	claims := &PersistentVolumeClaimList{}
+	err := getList(claimsEndpoint, claims)
 	if err != nil {
 		return nil, err
 	}
-
-	podList, err := getPods()
+	volumes := &PersistentVolumeList{}
+	err = getList(volumesEndpoint, volumes)
+	if err != nil {
+		return nil, err
+	}
+	classes := &StorageClassList{}
+	err = getList(classesEndpoint, classes)
+	if err != nil {
+		return nil, err
+	}
+	csiNodes := &CSINodeList{}
+	err = getList(csiNodesEndpoint, csiNodes)
 	if err != nil {
 		return nil, err
 	}
+	return &ClusterVolumes{Claims: claims.Items, Volumes: volumes.Items, Classes: classes.Items, CSINodes: csiNodes.Items}, nil
+}
+
+// getList decodes the list of objects at path into list.
+func getList(path string, list interface{}) error {
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Host:   apiHost,
+			Path:   path,
+			Scheme: "http",
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := apiClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("List " + path + ": Unexpected HTTP status code" + resp.Status + string(b))
+	}
+	return json.NewDecoder(resp.Body).Decode(list)
+}
+
+// annotateClaim sets an annotation on the persistent volume claim, with a
+// merge patch.
+func annotateClaim(claim *PersistentVolumeClaim, key, value string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	}
+	return patchObject(fmt.Sprintf(claimEndpoint, claim.Metadata.Namespace, claim.Metadata.Name), "application/merge-patch+json", patch)
+}
+
+// claimVolume reserves the volume for the claim, as kube-scheduler does, for
+// the PV controller to bind them. It fails if the volume changed since it
+// was listed, e.g. reserved for another claim.
+func claimVolume(pv *PersistentVolume, claim *PersistentVolumeClaim) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": pv.Metadata.ResourceVersion,
+		},
+		"spec": map[string]interface{}{
+			"claimRef": ObjectReference{
+				ApiVersion: "v1",
+				Kind:       "PersistentVolumeClaim",
+				Namespace:  claim.Metadata.Namespace,
+				Name:       claim.Metadata.Name,
+				Uid:        claim.Metadata.Uid,
+			},
+		},
+	}
+	return patchObject(fmt.Sprintf(volumeEndpoint, pv.Metadata.Name), "application/merge-patch+json", patch)
+}
 
-	resourceUsage := make(map[string]*ResourceUsage)
-	for _, node := range nodeList.Items {
-		resourceUsage[node.Metadata.Name] = &ResourceUsage{}
+// annotatePod sets an annotation on the pod, with a merge patch.
+func annotatePod(pod *Pod, key, value string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
 	}
+	return patchObject(fmt.Sprintf(podEndpoint, pod.Metadata.Namespace, pod.Metadata.Name), "application/merge-patch+json", patch)
+}
 
-	for _, p := range podList.Items {
-		if p.Spec.NodeName == "" {
+// updatePodScheduled sets the PodScheduled condition of the pod, through the
+// status subresource, unless it is already set so. Its transition time only
+// changes with its status.
+func updatePodScheduled(pod *Pod, status, reason, message string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	transition := now
+	for _, c := range pod.Status.Conditions {
+		if c.Type != "PodScheduled" {
 			continue
 		}
-		for _, c := range p.Spec.Containers {
-			if strings.HasSuffix(c.Resources.Requests["cpu"], "m") {
-				milliCores := strings.TrimSuffix(c.Resources.Requests["cpu"], "m")
-				cores, err := strconv.Atoi(milliCores)
-				if err != nil {
-					return nil, err
-				}
-				ru, exists := resourceUsage[p.Spec.NodeName]
-				if exists {
-					ru.CPU += cores
-				}
-			}
+		if c.Status == status && c.Reason == reason && c.Message == message {
+			return nil
 		}
+		if c.Status == status && c.LastTransitionTime != "" {
+			transition = c.LastTransitionTime
+		}
+	}
+
+	// A strategic merge patch merges the conditions by type, keeping the
+	// other ones. Null clears the reason and message.
+	condition := map[string]interface{}{
+		"type":               "PodScheduled",
+		"status":             status,
+		"reason":             nil,
+		"message":            nil,
+		"lastProbeTime":      nil,
+		"lastTransitionTime": transition,
+	}
+	if reason != "" {
+		condition["reason"] = reason
+	}
+	if message != "" {
+		condition["message"] = message
 	}
+	patch := map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []interface{}{condition},
+		},
+	}
+	return patchObject(fmt.Sprintf(podStatusEndpoint, pod.Metadata.Namespace, pod.Metadata.Name), "application/strategic-merge-patch+json", patch)
+}
 
-	var nodes []Node
-	fitFailures := make([]string, 0)
+// patchObject sends the patch of the object at path.
+func patchObject(path, contentType string, patch interface{}) error {
+	b, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
 
-	var spaceRequired int
-	for _, c := range pod.Spec.Containers {
-		if strings.HasSuffix(c.Resources.Requests["cpu"], "m") {
-			milliCores := strings.TrimSuffix(c.Resources.Requests["cpu"], "m")
-			cores, err := strconv.Atoi(milliCores)
-			if err != nil {
-				return nil, err
-			}
-			spaceRequired += cores
+	request := &http.Request{
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Header:        make(http.Header),
+		Method:        http.MethodPatch,
+		URL: &url.URL{
+			Host:   apiHost,
+			Path:   path,
+			Scheme: "http",
+		},
+	}
+	request.Header.Set("Content-Type", contentType)
+
+	resp, err := apiClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("Patch: Unexpected HTTP status code" + resp.Status + string(b))
+	}
+	return nil
+}
+
+// fitResult is the outcome of the filters: the nodes considered, the ones
+// the pod fits on and why it doesn't fit the others.
+type fitResult struct {
+	nodes    []*NodeInfo
+	feasible []*NodeInfo
+	failures map[string]string
+}
+
+func fit(log *Logger, pod *Pod) (*fitResult, error) {
+	err := checkPoliciesSynced()
+	if err != nil {
+		return nil, err
+	}
+
+	// cache.run keeps the cluster state fresh, it is only refreshed here
+	// when it runs late.
+	if cache.stale(currentConfig().CacheRefreshInterval.Duration) {
+		err = cache.refresh()
+		if err != nil {
+			log.Warn("Failed refreshing cluster state, using cached one", "err", err)
 		}
 	}
 
-	for _, node := range nodeList.Items {
-		var allocatableCores int
-		var err error
-		if strings.HasSuffix(node.Status.Allocatable["cpu"], "m") {
-			milliCores := strings.TrimSuffix(node.Status.Allocatable["cpu"], "m")
-			allocatableCores, err = strconv.Atoi(milliCores)
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			cpu := node.Status.Allocatable["cpu"]
-			cpuFloat, err := strconv.ParseFloat(cpu, 32)
-			if err != nil {
-				return nil, err
-			}
-			allocatableCores = int(cpuFloat * 1000)
+	nodeList, podList, volumes, err := cache.snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	nodeInfos, err := newNodeInfos(nodeList.Items, withoutPod(podList.Items, pod), volumes)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, failures := frameworkFor(pod).filter(log, pod, nodeInfos)
+	return &fitResult{nodes: nodeInfos, feasible: nodes, failures: failures}, nil
+}
+
+// withoutPod returns the pods other than pod. The pod doesn't count against
+// its node when it is already bound, as in shadow mode.
+func withoutPod(pods []Pod, pod *Pod) []Pod {
+	for i := range pods {
+		if pods[i].Metadata.Uid == pod.Metadata.Uid && pod.Metadata.Uid != "" {
+			return append(pods[:i:i], pods[i+1:]...)
 		}
+	}
+	return pods
+}
 
-		freeSpace := (allocatableCores - resourceUsage[node.Metadata.Name].CPU)
-		if freeSpace < spaceRequired {
-			m := fmt.Sprintf("fit failure on node (%s): Insufficient CPU", node.Metadata.Name)
-			fitFailures = append(fitFailures, m)
-			continue
+// postFailedScheduling emits a FailedScheduling event with the summary of
+// why the pod didn't fit any node.
+func postFailedScheduling(pod *Pod, profile, summary string) error {
+	return recorder.record(profile, objectReference(pod), "Warning", "FailedScheduling", "Scheduling", summary)
+}
+
+// failureSummary counts the nodes rejected for each reason, e.g. "0/12
+// nodes are available: 5 Insufficient memory, 7 node(s) didn't match node
+// selector.". A node rejected for several reasons counts for each.
+func failureSummary(nodes int, failures map[string]string) string {
+	counts := map[string]int{}
+	for _, failure := range failures {
+		// Failures are "Plugin: reason, reason...".
+		if i := strings.Index(failure, ": "); i != -1 {
+			failure = failure[i+2:]
 		}
-		nodes = append(nodes, *node)
-	}
-
-	if len(nodes) == 0 {
-		// Emit a Kubernetes event that the Pod was scheduled successfully.
-		timestamp := time.Now().UTC().Format(time.RFC3339)
-		event := Event{
-			Count:          1,
-			Message:        fmt.Sprintf("pod (%s) failed to fit in any node\n%s", pod.Metadata.Name, strings.Join(fitFailures, "\n")),
-			Metadata:       Metadata{GenerateName: pod.Metadata.Name + "-"},
-			Reason:         "FailedScheduling",
-			LastTimestamp:  timestamp,
-			FirstTimestamp: timestamp,
-			Type:           "Warning",
-			Source:         EventSource{Component: "hightower-scheduler"},
-			InvolvedObject: ObjectReference{
-				Kind:      "Pod",
-				Name:      pod.Metadata.Name,
-				Namespace: "default",
-				Uid:       pod.Metadata.Uid,
-			},
+		for _, reason := range strings.Split(failure, ", ") {
+			counts[reason]++
 		}
-
-		postEvent(event)
 	}
 
-	return nodes, nil
+	reasons := make([]string, 0, len(counts))
+	for reason, count := range counts {
+		reasons = append(reasons, fmt.Sprintf("%d %s", count, reason))
+	}
+	sort.Strings(reasons)
+	if len(reasons) == 0 {
+		return fmt.Sprintf("0/%d nodes are available.", nodes)
+	}
+	return fmt.Sprintf("0/%d nodes are available: %s.", nodes, strings.Join(reasons, ", "))
 }
 
-func bind(pod *Pod, node Node) error {
+var (
+	errPodGone      = errors.New("pod deleted")
+	errAlreadyBound = errors.New("pod already bound")
+	errNotLeader    = errors.New("leadership lost, not binding")
+)
+
+// bind binds the pod to the node. It returns errPodGone if the pod doesn't
+// exist anymore, and errAlreadyBound if it is bound already.
+func bind(log *Logger, pod *Pod, node *Node) error {
 	binding := Binding{
 		ApiVersion: "v1",
 		Kind:       "Binding",
@@ -437,35 +876,189 @@ func bind(pod *Pod, node Node) error {
 	}
 	request.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(request)
+	resp, err := apiClient.Do(request)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 201 {
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusNotFound:
+		return errPodGone
+	case http.StatusConflict:
+		return errAlreadyBound
+	default:
 		b, _ := ioutil.ReadAll(resp.Body)
 		return errors.New("Binding: Unexpected HTTP status code" + resp.Status + string(b))
 	}
 
+	log.Info("Pod bound", "node", node.Metadata.Name)
+
 	// Emit a Kubernetes event that the Pod was scheduled successfully.
-	message := fmt.Sprintf("Successfully assigned %s to %s", pod.Metadata.Name, node.Metadata.Name)
-	timestamp := time.Now().UTC().Format(time.RFC3339)
-	event := Event{
-		Namespace:      pod.Metadata.Namespace,
-		Count:          1,
-		Message:        message,
-		Metadata:       Metadata{GenerateName: pod.Metadata.Name + "-"},
-		Reason:         "Scheduled",
-		LastTimestamp:  timestamp,
-		FirstTimestamp: timestamp,
-		Type:           "Normal",
-		Source:         EventSource{Component: schedulerName},
-		InvolvedObject: ObjectReference{
-			Kind:      "Pod",
-			Name:      pod.Metadata.Name,
-			Namespace: pod.Metadata.Namespace,
-			Uid:       pod.Metadata.Uid,
+	message := fmt.Sprintf("Successfully assigned %s/%s to %s", pod.Metadata.Namespace, pod.Metadata.Name, node.Metadata.Name)
+	err = recorder.record(frameworkFor(pod).profile, objectReference(pod), "Normal", "Scheduled", "Binding", message)
+	if err != nil {
+		log.Warn("Failed posting event", "err", err)
+	}
+	return nil
+}
+
+// getPod returns the named pod, or nil if it does not exist.
+func getPod(namespace, name string) (*Pod, error) {
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Host:   apiHost,
+			Path:   fmt.Sprintf(podEndpoint, namespace, name),
+			Scheme: "http",
 		},
 	}
-	log.Println(message)
-	return postEvent(event)
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := apiClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("Pod: Unexpected HTTP status code" + resp.Status + string(b))
+	}
+
+	pod := &Pod{}
+	err = json.NewDecoder(resp.Body).Decode(pod)
+	if err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+// getJob returns the named Job, or nil if it does not exist.
+func getJob(namespace, name string) (*Job, error) {
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Host:   apiHost,
+			Path:   fmt.Sprintf(jobEndpoint, namespace, name),
+			Scheme: "http",
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := apiClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("Job: Unexpected HTTP status code" + resp.Status + string(b))
+	}
+
+	job := &Job{}
+	err = json.NewDecoder(resp.Body).Decode(job)
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// getLease returns the named Lease, or nil if it does not exist yet.
+func getLease(namespace, name string) (*Lease, error) {
+	request := &http.Request{
+		Header: make(http.Header),
+		Method: http.MethodGet,
+		URL: &url.URL{
+			Host:   apiHost,
+			Path:   fmt.Sprintf(leaseEndpoint, namespace, name),
+			Scheme: "http",
+		},
+	}
+	request.Header.Set("Accept", "application/json, */*")
+
+	resp, err := apiClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("Lease: Unexpected HTTP status code" + resp.Status + string(b))
+	}
+
+	lease := &Lease{}
+	err = json.NewDecoder(resp.Body).Decode(lease)
+	if err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// createLease creates a new Lease. It fails if somebody else created it first.
+func createLease(lease *Lease) (*Lease, error) {
+	return writeLease(http.MethodPost, fmt.Sprintf(leasesEndpoint, lease.Metadata.Namespace), lease)
+}
+
+// updateLease replaces an existing Lease. The resourceVersion in the
+// metadata makes the update fail with a conflict if the Lease changed since
+// it was read.
+func updateLease(lease *Lease) (*Lease, error) {
+	return writeLease(http.MethodPut, fmt.Sprintf(leaseEndpoint, lease.Metadata.Namespace, lease.Metadata.Name), lease)
+}
+
+func writeLease(method, path string, lease *Lease) (*Lease, error) {
+	lease.ApiVersion = "coordination.k8s.io/v1"
+	lease.Kind = "Lease"
+
+	var b []byte
+	body := bytes.NewBuffer(b)
+	err := json.NewEncoder(body).Encode(lease)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &http.Request{
+		Body:          ioutil.NopCloser(body),
+		ContentLength: int64(body.Len()),
+		Header:        make(http.Header),
+		Method:        method,
+		URL: &url.URL{
+			Host:   apiHost,
+			Path:   path,
+			Scheme: "http",
+		},
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := apiClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New("Lease: Unexpected HTTP status code" + resp.Status + string(b))
+	}
+
+	result := &Lease{}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
@@ -0,0 +1,249 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// leaderElector implements Lease based leader election, following the same
+// semantics as client-go: a replica holds the lease as long as it renews it
+// within leaseDuration, and the other replicas only take it over once they
+// did not observe any renewal for a whole leaseDuration.
+type leaderElector struct {
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+
+	observedLease *Lease
+	observedTime  time.Time
+
+	leaderLock sync.RWMutex
+	leader     bool
+}
+
+func newLeaderElector(namespace, name, identity string, leaseDuration, renewDeadline, retryPeriod time.Duration) (*leaderElector, error) {
+	if leaseDuration <= renewDeadline {
+		return nil, fmt.Errorf("lease duration (%s) must be greater than the renew deadline (%s)", leaseDuration, renewDeadline)
+	}
+	if renewDeadline <= retryPeriod {
+		return nil, fmt.Errorf("renew deadline (%s) must be greater than the retry period (%s)", renewDeadline, retryPeriod)
+	}
+	if identity == "" {
+		return nil, fmt.Errorf("leader election identity must not be empty")
+	}
+
+	return &leaderElector{
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		renewDeadline: renewDeadline,
+		retryPeriod:   retryPeriod,
+	}, nil
+}
+
+// leaderIdentity returns a unique identity for this replica, based on the
+// hostname (the pod name when running on Kubernetes).
+func leaderIdentity() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = schedulerName
+	}
+
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "_" + hex.EncodeToString(b)
+}
+
+// leading tells whether this replica may bind pods: it holds the lease, or
+// leader election is disabled.
+func leading() bool {
+	return elector == nil || elector.isLeader()
+}
+
+func (le *leaderElector) isLeader() bool {
+	le.leaderLock.RLock()
+	defer le.leaderLock.RUnlock()
+	return le.leader
+}
+
+func (le *leaderElector) setLeader(leader bool) {
+	le.leaderLock.Lock()
+	defer le.leaderLock.Unlock()
+	le.leader = leader
+}
+
+// run campaigns for leadership until done is closed. Every time the lease is
+// acquired, lead is called with a channel which is closed as soon as the
+// leadership is lost; run waits for lead to return before campaigning again.
+func (le *leaderElector) run(done chan struct{}, wg *sync.WaitGroup, lead func(stop chan struct{})) {
+	defer wg.Done()
+
+	for {
+		if !le.acquire(done) {
+			logger.Info("Stopped leader election")
+			return
+		}
+
+		logger.Info("Acquired lease", "lease", le.namespace+"/"+le.name, "identity", le.identity)
+		le.setLeader(true)
+
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			lead(stop)
+			close(stopped)
+		}()
+
+		released := le.renew(done)
+		le.setLeader(false)
+		close(stop)
+		<-stopped
+
+		if released {
+			le.release()
+			logger.Info("Stopped leader election")
+			return
+		}
+		logger.Warn("Lost lease", "lease", le.namespace+"/"+le.name, "identity", le.identity)
+	}
+}
+
+// acquire blocks until the lease is acquired, or done is closed. It returns
+// false in the latter case.
+func (le *leaderElector) acquire(done chan struct{}) bool {
+	for {
+		if le.tryAcquireOrRenew() {
+			return true
+		}
+
+		select {
+		case <-time.After(le.retryPeriod):
+		case <-done:
+			return false
+		}
+	}
+}
+
+// renew keeps renewing the lease, and returns once it could not be renewed
+// within the renew deadline, or done is closed. It returns true in the
+// latter case.
+func (le *leaderElector) renew(done chan struct{}) bool {
+	lastRenew := time.Now()
+	for {
+		select {
+		case <-time.After(le.retryPeriod):
+		case <-done:
+			return true
+		}
+
+		if le.tryAcquireOrRenew() {
+			lastRenew = time.Now()
+			continue
+		}
+
+		if time.Since(lastRenew) > le.renewDeadline {
+			return false
+		}
+	}
+}
+
+// tryAcquireOrRenew creates the lease, or updates it if it is held by this
+// replica or has expired. It returns true if this replica holds the lease.
+func (le *leaderElector) tryAcquireOrRenew() bool {
+	now := time.Now()
+	spec := LeaseSpec{
+		HolderIdentity:       le.identity,
+		LeaseDurationSeconds: int(le.leaseDuration / time.Second),
+		AcquireTime:          now.UTC().Format(leaseTimeFormat),
+		RenewTime:            now.UTC().Format(leaseTimeFormat),
+	}
+
+	lease, err := getLease(le.namespace, le.name)
+	if err != nil {
+		logger.Warn("Failed getting lease", "err", err)
+		return false
+	}
+
+	if lease == nil {
+		lease, err = createLease(&Lease{
+			Metadata: Metadata{Name: le.name, Namespace: le.namespace},
+			Spec:     spec,
+		})
+		if err != nil {
+			logger.Warn("Failed creating lease", "err", err)
+			return false
+		}
+		le.observe(lease, now)
+		return true
+	}
+
+	if le.observedLease == nil || le.observedLease.Spec != lease.Spec {
+		le.observe(lease, now)
+	}
+
+	held := lease.Spec.HolderIdentity == le.identity
+	if !held && lease.Spec.HolderIdentity != "" && le.observedTime.Add(le.leaseDuration).After(now) {
+		return false
+	}
+
+	if held {
+		spec.AcquireTime = lease.Spec.AcquireTime
+		spec.LeaseTransitions = lease.Spec.LeaseTransitions
+	} else {
+		spec.LeaseTransitions = lease.Spec.LeaseTransitions + 1
+	}
+	lease.Spec = spec
+
+	lease, err = updateLease(lease)
+	if err != nil {
+		logger.Warn("Failed updating lease", "err", err)
+		return false
+	}
+	le.observe(lease, now)
+	return true
+}
+
+// release gives up the lease, so that a standby replica can take over
+// without waiting for it to expire.
+func (le *leaderElector) release() {
+	lease, err := getLease(le.namespace, le.name)
+	if err != nil || lease == nil || lease.Spec.HolderIdentity != le.identity {
+		return
+	}
+
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	lease.Spec.RenewTime = time.Now().UTC().Format(leaseTimeFormat)
+	_, err = updateLease(lease)
+	if err != nil {
+		logger.Warn("Failed releasing lease", "err", err)
+	}
+}
+
+func (le *leaderElector) observe(lease *Lease, t time.Time) {
+	le.observedLease = lease
+	le.observedTime = t
+}
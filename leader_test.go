@@ -0,0 +1,115 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// candidate runs a leaderElector and records whether it is currently leading.
+type candidate struct {
+	le      *leaderElector
+	done    chan struct{}
+	wg      sync.WaitGroup
+	leading chan bool
+}
+
+func startCandidate(t *testing.T, identity string) *candidate {
+	le, err := newLeaderElector("test", "lease", identity, 600*time.Millisecond, 400*time.Millisecond, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &candidate{le: le, done: make(chan struct{}), leading: make(chan bool, 10)}
+	c.wg.Add(1)
+	go le.run(c.done, &c.wg, func(stop chan struct{}) {
+		c.leading <- true
+		<-stop
+		c.leading <- false
+	})
+	return c
+}
+
+func (c *candidate) stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+func expectLeading(t *testing.T, c *candidate, leading bool, within time.Duration) {
+	t.Helper()
+	select {
+	case l := <-c.leading:
+		if l != leading {
+			t.Fatalf("%s: expected leading=%t, got %t", c.le.identity, leading, l)
+		}
+	case <-time.After(within):
+		t.Fatalf("%s: expected leading=%t within %s", c.le.identity, leading, within)
+	}
+}
+
+func TestLeaderElectionFailover(t *testing.T) {
+	server := startFakeAPIServer(t)
+
+	a := startCandidate(t, "a")
+	defer a.stop()
+	expectLeading(t, a, true, time.Second)
+
+	b := startCandidate(t, "b")
+	defer b.stop()
+
+	select {
+	case <-b.leading:
+		t.Fatal("standby acquired a lease held by a live leader")
+	case <-time.After(time.Second):
+	}
+
+	// The leader can no longer renew: it must step down after the renew
+	// deadline, and the standby must take over once the lease expired.
+	server.partition("a")
+	expectLeading(t, a, false, time.Second)
+	expectLeading(t, b, true, 2*time.Second)
+
+	if server.leaseHolder() != "b" {
+		t.Fatalf("expected lease to be held by b, got %q", server.leaseHolder())
+	}
+	if a.le.isLeader() || !b.le.isLeader() {
+		t.Fatal("unexpected leadership state")
+	}
+}
+
+func TestLeaderElectionRelease(t *testing.T) {
+	server := startFakeAPIServer(t)
+
+	a := startCandidate(t, "a")
+	expectLeading(t, a, true, time.Second)
+
+	b := startCandidate(t, "b")
+	defer b.stop()
+
+	// A graceful shutdown releases the lease, the standby doesn't need to
+	// wait for it to expire.
+	start := time.Now()
+	a.stop()
+	expectLeading(t, a, false, time.Second)
+	expectLeading(t, b, true, time.Second)
+
+	if time.Since(start) >= 600*time.Millisecond {
+		t.Fatalf("failover took %s, longer than the lease duration", time.Since(start))
+	}
+	if server.leaseHolder() != "b" {
+		t.Fatalf("expected lease to be held by b, got %q", server.leaseHolder())
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (l logLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == l {
+			return name
+		}
+	}
+	return strconv.Itoa(int(l))
+}
+
+var logOutput = struct {
+	sync.Mutex
+	w     io.Writer
+	level logLevel
+	json  bool
+}{w: os.Stderr, level: levelInfo}
+
+// setLogging sets the minimum level logged, and the format of the lines:
+// logfmt or json.
+func setLogging(level, format string) error {
+	l, ok := logLevelNames[level]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	if format != "logfmt" && format != "json" {
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.level = l
+	logOutput.json = format == "json"
+	return nil
+}
+
+// Logger writes structured, levelled log lines. The key/value pairs given
+// to With are added to every line written by the returned Logger.
+type Logger struct {
+	fields []interface{}
+}
+
+var logger = &Logger{}
+
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keysAndValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keysAndValues...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(levelDebug, msg, keysAndValues)
+}
+
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(levelInfo, msg, keysAndValues)
+}
+
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(levelWarn, msg, keysAndValues)
+}
+
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(levelError, msg, keysAndValues)
+}
+
+// enabled tells whether the messages of the level are logged, to skip
+// building the fields of the others.
+func (l *Logger) enabled(level logLevel) bool {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	return level >= logOutput.level
+}
+
+func (l *Logger) log(level logLevel, msg string, keysAndValues []interface{}) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	if level < logOutput.level {
+		return
+	}
+
+	fields := append([]interface{}{
+		"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(),
+		"msg", msg,
+	}, l.fields...)
+	fields = append(fields, keysAndValues...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(MISSING)")
+	}
+
+	var line bytes.Buffer
+	if logOutput.json {
+		line.WriteString("{")
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if logOutput.json {
+			if i != 0 {
+				line.WriteString(",")
+			}
+			k, _ := json.Marshal(key)
+			line.Write(k)
+			line.WriteString(":")
+			line.Write(jsonValue(fields[i+1]))
+		} else {
+			if i != 0 {
+				line.WriteString(" ")
+			}
+			line.WriteString(key)
+			line.WriteString("=")
+			line.WriteString(logfmtValue(fields[i+1]))
+		}
+	}
+	if logOutput.json {
+		line.WriteString("}")
+	}
+	line.WriteString("\n")
+	logOutput.w.Write(line.Bytes())
+}
+
+func jsonValue(v interface{}) []byte {
+	switch value := v.(type) {
+	case error:
+		v = value.Error()
+	case fmt.Stringer:
+		v = value.String()
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
+
+func logfmtValue(v interface{}) string {
+	var s string
+	switch value := v.(type) {
+	case error:
+		s = value.Error()
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	if s == "" || strings.ContainsAny(s, " =\"\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+var schedulingAttempts uint64
+
+// attemptLogger returns the Logger for a scheduling attempt of the pod: each
+// line carries the pod and the ID of the attempt.
+func attemptLogger(pod *Pod) *Logger {
+	return logger.With(
+		"namespace", pod.Metadata.Namespace,
+		"pod", pod.Metadata.Name,
+		"uid", pod.Metadata.Uid,
+		"attempt", atomic.AddUint64(&schedulingAttempts, 1),
+	)
+}
@@ -15,10 +15,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 )
@@ -28,33 +30,140 @@ const schedulerName = "k8s-resource-scheduler"
 var Queue chan *Pod
 
 func main() {
-	log.Println(fmt.Sprintf("Starting %s scheduler...", schedulerName))
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "simulate":
+			os.Exit(simulateCommand(os.Args[2:]))
+		case "snapshot":
+			os.Exit(snapshotCommand(os.Args[2:]))
+		}
+	}
+
+	cfg, err := parseConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if cfg == nil {
+		// --print-default-config
+		os.Exit(0)
+	}
+
+	err = applyConfig(cfg)
+	if err != nil {
+		logger.Error("Invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	apiHost = cfg.API.Host
+	metricsEndpoint = cfg.API.NodeMetricsPath
+	podMetricsEndpoint = cfg.API.PodMetricsPath
+	apiClient = &http.Client{Transport: instrumentedTransport{next: http.DefaultTransport}}
+
+	logger.Info("Starting scheduler", "name", schedulerName, "profiles", strings.Join(cfg.schedulerNames(), ","), "shadow", cfg.Shadow)
+
+	auditSinks, err = newAuditSinks(cfg.Audit)
+	if err != nil {
+		logger.Error("Failed setting up audit sinks", "err", err)
+		os.Exit(1)
+	}
 
 	doneChan := make(chan struct{})
-	Queue = make(chan *Pod, 100)
+	Queue = make(chan *Pod, cfg.QueueSize)
 
 	var wg sync.WaitGroup
 
+	if cfg.BindAddress != "" {
+		wg.Add(1)
+		go serveHTTP(cfg.BindAddress, doneChan, &wg)
+	}
+	if cfg.Extender.BindAddress != "" {
+		wg.Add(1)
+		go serveExtender(cfg.Extender.BindAddress, doneChan, &wg)
+	}
+
 	wg.Add(1)
-	go monitorUnscheduledPods(doneChan, &wg)
+	go cache.run(cfg.CacheRefreshInterval.Duration, doneChan, &wg)
 
-	for i := 0; i < 10; i++ {
+	if cfg.Policies.Enabled {
 		wg.Add(1)
-		go scheduleQueue(doneChan, Queue, &wg)
+		go policies.run(doneChan, &wg)
+	}
+	if cfg.UsageHistory.Enabled {
+		wg.Add(1)
+		go usageHistory.run(cfg.UsageHistory.Interval.Duration, doneChan, &wg)
 	}
 
-	wg.Add(1)
-	go reconcileUnscheduledPods(30, doneChan, &wg)
+	reloader := &configReloader{args: os.Args[1:]}
+	if cfg.file != "" && cfg.Reload.FileInterval.Duration > 0 {
+		wg.Add(1)
+		go reloader.watchFile(cfg.file, cfg.Reload.FileInterval.Duration, doneChan, &wg)
+	}
+	if cfg.Reload.ConfigMap != "" {
+		wg.Add(1)
+		go reloader.watchConfigMap(cfg.Reload.ConfigMap, cfg.Reload.ConfigMapKey, doneChan, &wg)
+	}
+
+	run := runScheduler
+	if cfg.Shadow {
+		run = runShadow
+	}
+
+	if cfg.LeaderElection.Enabled {
+		elector, err = newLeaderElector(
+			cfg.LeaderElection.Namespace,
+			cfg.LeaderElection.LeaseName,
+			leaderIdentity(),
+			cfg.LeaderElection.LeaseDuration.Duration,
+			cfg.LeaderElection.RenewDeadline.Duration,
+			cfg.LeaderElection.RetryPeriod.Duration,
+		)
+		if err != nil {
+			logger.Error("Failed setting up leader election", "err", err)
+			os.Exit(1)
+		}
+
+		wg.Add(1)
+		go elector.run(doneChan, &wg, run)
+	} else {
+		wg.Add(1)
+		go func() {
+			run(doneChan)
+			wg.Done()
+		}()
+	}
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 	for {
 		select {
 		case <-signalChan:
-			log.Printf("Shutdown signal received, exiting...")
+			logger.Info("Shutdown signal received, exiting")
 			close(doneChan)
 			wg.Wait()
+			closeAuditSinks()
 			os.Exit(0)
 		}
 	}
 }
+
+// runScheduler runs the scheduling loops until stop is closed.
+func runScheduler(stop chan struct{}) {
+	var wg sync.WaitGroup
+	cfg := currentConfig()
+
+	wg.Add(1)
+	go monitorUnscheduledPods(stop, &wg)
+
+	for i := 0; i < cfg.Workers; i++ {
+		wg.Add(1)
+		go scheduleQueue(stop, Queue, &wg)
+	}
+
+	wg.Add(1)
+	go reconcileUnscheduledPods(cfg.ReconcileInterval.Duration, stop, &wg)
+
+	wg.Wait()
+}
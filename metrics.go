@@ -0,0 +1,300 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This file implements the subset of the Prometheus text exposition format
+// the scheduler needs: counters, gauges and histograms with labels.
+
+var latencyBuckets = []float64{0.001, 0.002, 0.004, 0.008, 0.016, 0.032, 0.064, 0.128, 0.256, 0.512, 1.024, 2.048, 4.096, 8.192, 16.384}
+
+var (
+	scheduleAttempts = newCounterVec("scheduler_schedule_attempts_total",
+		"Number of attempts to schedule pods, by result and profile.", "result", "profile")
+	e2eSchedulingDuration = newHistogramVec("scheduler_e2e_scheduling_duration_seconds",
+		"End to end latency of scheduling attempts, by result.", latencyBuckets, "result")
+	schedulingPhaseDuration = newHistogramVec("scheduler_scheduling_phase_duration_seconds",
+		"Latency of each phase of the scheduling attempts.", latencyBuckets, "phase")
+	pendingPods = newGaugeFunc("scheduler_pending_pods",
+		"Number of pods waiting in each scheduling sub-queue.", []string{"queue"}, queueDepths)
+	apiRequests = newCounterVec("scheduler_api_requests_total",
+		"Number of requests to the Kubernetes API, by endpoint, method and status code.", "endpoint", "method", "code")
+	apiRequestDuration = newHistogramVec("scheduler_api_request_duration_seconds",
+		"Latency of the requests to the Kubernetes API, by endpoint and method.", latencyBuckets, "endpoint", "method")
+	shadowDecisions = newCounterVec("scheduler_shadow_decisions_total",
+		"Placements computed in shadow mode, by result and scheduler of the pod.", "result", "scheduler")
+	extenderRequests = newCounterVec("scheduler_extender_requests_total",
+		"Number of kube-scheduler extender requests, by verb and result.", "verb", "result")
+	extenderRequestDuration = newHistogramVec("scheduler_extender_request_duration_seconds",
+		"Latency of the kube-scheduler extender requests, by verb.", latencyBuckets, "verb")
+	nodeMetricsAge = newGaugeFunc("scheduler_node_metrics_age_seconds",
+		"Age of the usage metrics known for each node.", []string{"node"}, nodeMetricsAges)
+	leaderStatus = newGaugeFunc("scheduler_leader",
+		"Whether this replica may bind pods: 1 when it holds the lease or leader election is disabled, else 0.", nil, leaderValue)
+)
+
+type collector interface {
+	write(w io.Writer)
+}
+
+var collectors = []collector{
+	scheduleAttempts,
+	e2eSchedulingDuration,
+	schedulingPhaseDuration,
+	pendingPods,
+	apiRequests,
+	apiRequestDuration,
+	shadowDecisions,
+	extenderRequests,
+	extenderRequestDuration,
+	nodeMetricsAge,
+	leaderStatus,
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+type counterVec struct {
+	sync.Mutex
+	name, help string
+	labels     []string
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	c.values[labelKey(labelValues)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	sync.Mutex
+	name, help string
+	labels     []string
+	buckets    []float64
+	values     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	key := labelKey(labelValues)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := []string{}
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+		for i, b := range h.buckets {
+			le := `le="` + formatValue(b) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, le), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, `le="+Inf"`), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+// gaugeFunc is a gauge computed when scraped.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func() map[string]float64
+}
+
+func newGaugeFunc(name, help string, labels []string, collect func() map[string]float64) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, labels: labels, collect: collect}
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	values := g.collect()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, key, ""), formatValue(values[key]))
+	}
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, key string, extra string) string {
+	pairs := []string{}
+	if len(names) != 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", names[i], strconv.Quote(v)))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// instrumentedTransport records the count and latency of the requests to the
+// Kubernetes API.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	endpoint := endpointLabel(r.URL.Path)
+
+	resp, err := t.next.RoundTrip(r)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+
+	apiRequests.inc(endpoint, r.Method, code)
+	apiRequestDuration.since(start, endpoint, r.Method)
+	return resp, err
+}
+
+var namedResources = map[string]bool{
+	"pods":       true,
+	"nodes":      true,
+	"leases":     true,
+	"configmaps": true,
+	"events":     true,
+	"jobs":       true,
+
+	"persistentvolumes":      true,
+	"persistentvolumeclaims": true,
+}
+
+// endpointLabel replaces the namespace and object names in an API path with
+// placeholders, to keep the cardinality of the metrics low.
+func endpointLabel(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		switch {
+		case segments[i-1] == "namespaces":
+			segments[i] = "{namespace}"
+		case namedResources[segments[i-1]] && segments[i] != "":
+			segments[i] = "{name}"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// nodeMetricsAges returns how old the usage metrics of each node are.
+func nodeMetricsAges() map[string]float64 {
+	ages := map[string]float64{}
+	nodes, _, _, err := cache.snapshot()
+	if err != nil {
+		return ages
+	}
+
+	for _, n := range nodes.Items {
+		t, err := time.Parse(time.RFC3339, n.NodeMetrics.Timestamp)
+		if err != nil {
+			continue
+		}
+		ages[n.Metadata.Name] = time.Since(t).Seconds()
+	}
+	return ages
+}
+
+// leaderValue returns 1 when this replica may bind pods, else 0.
+func leaderValue() map[string]float64 {
+	if leading() {
+		return map[string]float64{"": 1}
+	}
+	return map[string]float64{"": 0}
+}
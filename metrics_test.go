@@ -0,0 +1,31 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+func TestEndpointLabel(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/api/v1/nodes": "/api/v1/nodes",
+		"/api/v1/namespaces/default/pods/job-1/binding/":     "/api/v1/namespaces/{namespace}/pods/{name}/binding",
+		"/api/v1/namespaces/default/pods/job-1/status":       "/api/v1/namespaces/{namespace}/pods/{name}/status",
+		"/apis/metrics.k8s.io/v1beta1/nodes/worker-1":        "/apis/metrics.k8s.io/v1beta1/nodes/{name}",
+		"/apis/batch/v1/namespaces/default/jobs/report-1":    "/apis/batch/v1/namespaces/{namespace}/jobs/{name}",
+		"/apis/events.k8s.io/v1/namespaces/default/events/x": "/apis/events.k8s.io/v1/namespaces/{namespace}/events/{name}",
+	} {
+		if label := endpointLabel(path); label != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, label)
+		}
+	}
+}
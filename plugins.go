@@ -0,0 +1,408 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	filterPlugins["NodeReady"] = func(*Config) FilterPlugin { return nodeReadyFilter{} }
+	filterPlugins["NodeUnschedulable"] = func(*Config) FilterPlugin { return nodeUnschedulable{} }
+	filterPlugins["NodeConditions"] = func(*Config) FilterPlugin { return nodeConditions{} }
+	filterPlugins["NodeSelector"] = func(*Config) FilterPlugin { return nodeSelector{} }
+	filterPlugins["NodePorts"] = func(*Config) FilterPlugin { return nodePorts{} }
+	filterPlugins["NodeResourcesFit"] = func(cfg *Config) FilterPlugin { return nodeResourcesFit{cfg: cfg} }
+	filterPlugins["MaxParallelJobs"] = func(cfg *Config) FilterPlugin {
+		return maxParallelJobs{threshold: cfg.MaxParallelJobs, cfg: cfg}
+	}
+
+	scorePlugins["LeastUsage"] = func(cfg *Config) ScorePlugin { return leastUsage{cfg: cfg} }
+	scorePlugins["LeastAllocated"] = func(*Config) ScorePlugin { return leastAllocated{} }
+	scorePlugins["MostAllocated"] = func(*Config) ScorePlugin { return mostAllocated{} }
+}
+
+// nodeReadyFilter rejects the nodes which are not Ready.
+type nodeReadyFilter struct{}
+
+func (nodeReadyFilter) Name() string { return "NodeReady" }
+
+func (nodeReadyFilter) Filter(pod *Pod, node *NodeInfo) error {
+	if !nodeReady(node.Node) {
+		return errors.New("node(s) were not ready")
+	}
+	return nil
+}
+
+// nodeUnschedulable rejects the cordoned nodes.
+type nodeUnschedulable struct{}
+
+func (nodeUnschedulable) Name() string { return "NodeUnschedulable" }
+
+func (nodeUnschedulable) Filter(pod *Pod, node *NodeInfo) error {
+	if node.Node.Spec.Unschedulable {
+		return errors.New("node(s) were unschedulable")
+	}
+	return nil
+}
+
+// nodeConditionReasons are the node conditions nodeConditions rejects the
+// nodes for, when true.
+var nodeConditionReasons = map[string]string{
+	"MemoryPressure":     "node(s) had memory pressure",
+	"DiskPressure":       "node(s) had disk pressure",
+	"PIDPressure":        "node(s) had pid pressure",
+	"NetworkUnavailable": "node(s) had unavailable network",
+}
+
+// nodeConditions rejects the nodes under memory, disk or PID pressure, or
+// without network. Pods tolerate conditions listed in their
+// tolerate-node-conditions annotation, e.g. "DiskPressure,PIDPressure".
+type nodeConditions struct{}
+
+func (nodeConditions) Name() string { return "NodeConditions" }
+
+func (nodeConditions) Filter(pod *Pod, node *NodeInfo) error {
+	tolerated := strings.Split(getProperty("tolerate-node-conditions", pod.Metadata), ",")
+	for i := range tolerated {
+		tolerated[i] = strings.TrimSpace(tolerated[i])
+	}
+
+	reasons := []string{}
+	for _, c := range node.Node.Status.Conditions {
+		reason, ok := nodeConditionReasons[c.Type]
+		if ok && c.Status == "True" && !contains(tolerated, c.Type) {
+			reasons = append(reasons, reason)
+		}
+	}
+	if len(reasons) != 0 {
+		return errors.New(strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// nodeSelector rejects the nodes which don't match the pod nodeSelector.
+type nodeSelector struct{}
+
+func (nodeSelector) Name() string { return "NodeSelector" }
+
+func (nodeSelector) Filter(pod *Pod, node *NodeInfo) error {
+	for l, v := range pod.Spec.NodeSelector {
+		if node.Node.Metadata.Labels[l] != v {
+			return errors.New("node(s) didn't match node selector")
+		}
+	}
+	return nil
+}
+
+// nodePorts rejects the nodes where a host port of the pod is already used
+// by another pod, on the same protocol and an overlapping host IP.
+type nodePorts struct{}
+
+func (nodePorts) Name() string { return "NodePorts" }
+
+func (nodePorts) Filter(pod *Pod, node *NodeInfo) error {
+	wanted := hostPorts(pod)
+	if len(wanted) == 0 {
+		return nil
+	}
+
+	for _, p := range node.Pods {
+		for _, used := range hostPorts(p) {
+			for _, w := range wanted {
+				if w.conflicts(used) {
+					return errors.New("node(s) didn't have free ports for the requested pod ports")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hostPort is a port a pod uses on its node.
+type hostPort struct {
+	ip       string
+	protocol string
+	port     int32
+}
+
+// conflicts tells whether both ports can't be used at the same time. The
+// unspecified address, 0.0.0.0, overlaps all the others.
+func (p hostPort) conflicts(other hostPort) bool {
+	if p.port != other.port || p.protocol != other.protocol {
+		return false
+	}
+	return p.ip == other.ip || p.ip == "0.0.0.0" || other.ip == "0.0.0.0"
+}
+
+// hostPorts returns the ports the pod uses on its node: the host ports of
+// its containers, and all their ports with the host network, the container
+// port being the host port then.
+func hostPorts(pod *Pod) []hostPort {
+	ports := []hostPort{}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			port := p.HostPort
+			if pod.Spec.HostNetwork {
+				port = p.ContainerPort
+			}
+			if port <= 0 {
+				continue
+			}
+
+			hp := hostPort{ip: p.HostIP, protocol: p.Protocol, port: port}
+			if hp.ip == "" {
+				hp.ip = "0.0.0.0"
+			}
+			if hp.protocol == "" {
+				hp.protocol = "TCP"
+			}
+			ports = append(ports, hp)
+		}
+	}
+	return ports
+}
+
+// nodeResourcesFit rejects the nodes which don't have enough allocatable
+// resources left for the pod requests, overcommitted by the overcommitRatio
+// of their node pool. In usage admission mode, it rejects the nodes whose
+// predicted usage would exceed the usage thresholds instead.
+type nodeResourcesFit struct {
+	cfg *Config
+}
+
+func (nodeResourcesFit) Name() string { return "NodeResourcesFit" }
+
+func (p nodeResourcesFit) Filter(pod *Pod, node *NodeInfo) error {
+	cpu, memory, err := podRequests(pod)
+	if err != nil {
+		return err
+	}
+
+	allocatableCPU, err := milliCPU(node.Node.Status.Allocatable["cpu"])
+	if err != nil {
+		return err
+	}
+	allocatableMemory, err := memoryBytes(node.Node.Status.Allocatable["memory"])
+	if err != nil {
+		return err
+	}
+
+	usage := node.Node.NodeMetrics.Usage
+	if admissionMode(p.cfg, pod) == admissionUsage && usage.Cpu != "" && usage.Memory != "" {
+		return p.fitUsage(pod, node, cpu, memory, allocatableCPU, allocatableMemory)
+	}
+
+	if ratio := node.Pool.overcommitRatio(); ratio != 1 {
+		allocatableCPU = int64(float64(allocatableCPU) * ratio)
+		allocatableMemory = int64(float64(allocatableMemory) * ratio)
+	}
+
+	insufficient := []string{}
+	if allocatableCPU-node.RequestedCPU < cpu {
+		insufficient = append(insufficient, "Insufficient cpu")
+	}
+	if allocatableMemory != 0 && allocatableMemory-node.RequestedMemory < memory {
+		insufficient = append(insufficient, "Insufficient memory")
+	}
+	if len(insufficient) != 0 {
+		return errors.New(strings.Join(insufficient, ", "))
+	}
+	return nil
+}
+
+// fitUsage admits the pod on the node when the predicted usage of the node
+// with the pod stays under the usage thresholds. The requests are
+// capped at maxOvercommitRatio times the allocatable resources.
+func (p nodeResourcesFit) fitUsage(pod *Pod, node *NodeInfo, cpu, memory, allocatableCPU, allocatableMemory int64) error {
+	a := p.cfg.Admission
+	predictedCPU, predictedMemory, err := predictedUsage(p.cfg, pod, node)
+	if err != nil {
+		return err
+	}
+
+	insufficient := []string{}
+	if float64(node.RequestedCPU+cpu) > float64(allocatableCPU)*a.MaxOvercommitRatio {
+		insufficient = append(insufficient, "Insufficient cpu")
+	} else if float64(predictedCPU) > float64(allocatableCPU)*a.CPUThreshold {
+		insufficient = append(insufficient, "node(s) would exceed the cpu usage threshold")
+	}
+	if allocatableMemory != 0 {
+		if float64(node.RequestedMemory+memory) > float64(allocatableMemory)*a.MaxOvercommitRatio {
+			insufficient = append(insufficient, "Insufficient memory")
+		} else if float64(predictedMemory) > float64(allocatableMemory)*a.MemoryThreshold {
+			insufficient = append(insufficient, "node(s) would exceed the memory usage threshold")
+		}
+	}
+	if len(insufficient) != 0 {
+		return errors.New(strings.Join(insufficient, ", "))
+	}
+	return nil
+}
+
+// maxParallelJobs rejects the nodes already running threshold pods
+// scheduled by us, or the maxParallelJobs of the pod policy. It is a no-op
+// when the limit is 0.
+type maxParallelJobs struct {
+	threshold int
+	cfg       *Config
+}
+
+func (maxParallelJobs) Name() string { return "MaxParallelJobs" }
+
+func (p maxParallelJobs) Filter(pod *Pod, node *NodeInfo) error {
+	if limit := policyFor(pod).maxParallelJobs; limit != nil {
+		p.threshold = *limit
+	}
+	if p.threshold == 0 {
+		return nil
+	}
+
+	running := 0
+	for _, np := range node.Pods {
+		if np.Status.Phase == "Running" && p.cfg.ownsPod(np) {
+			running++
+		}
+	}
+	if running >= p.threshold {
+		return fmt.Errorf("node(s) already running %d jobs", p.threshold)
+	}
+	return nil
+}
+
+// leastUsage favours the nodes with the lowest predicted CPU and memory
+// usage with the pod, from the usage reported by the metrics server and the
+// estimated usage of the pods. Pods or nodes annotated as cpu-bound (or
+// memory-bound) are scored on the CPU (or memory) usage only, and io-bound
+// pods on the io-bound pods already on the node.
+type leastUsage struct {
+	cfg *Config
+}
+
+func (leastUsage) Name() string { return "LeastUsage" }
+
+func (p leastUsage) Score(pod *Pod, node *NodeInfo) (int64, error) {
+	bound := policyFor(pod).bound
+	if bound.io {
+		return ioScore(node), nil
+	}
+
+	usage := node.Node.NodeMetrics.Usage
+	if usage.Cpu == "" || usage.Memory == "" {
+		// No metrics for the node, we can't tell how busy it is.
+		return 0, nil
+	}
+
+	cpu, memory, err := predictedUsage(p.cfg, pod, node)
+	if err != nil {
+		return 0, err
+	}
+	allocatableCPU, err := milliCPU(node.Node.Status.Allocatable["cpu"])
+	if err != nil {
+		return 0, err
+	}
+	allocatableMemory, err := memoryBytes(node.Node.Status.Allocatable["memory"])
+	if err != nil {
+		return 0, err
+	}
+	cpuScore := maxNodeScore - share(cpu, allocatableCPU)
+	memoryScore := maxNodeScore - share(memory, allocatableMemory)
+
+	cpuBound := bound.cpu || getPropertyBool("cpu-bound", node.Node.Metadata)
+	memoryBound := bound.memory || getPropertyBool("memory-bound", node.Node.Metadata)
+
+	switch {
+	case cpuBound && !memoryBound:
+		return cpuScore, nil
+	case memoryBound && !cpuBound:
+		return memoryScore, nil
+	default:
+		return (cpuScore + memoryScore) / 2, nil
+	}
+}
+
+// ioScore favours the nodes running the fewest io-bound pods, the metrics
+// server doesn't report disk and network usage.
+func ioScore(node *NodeInfo) int64 {
+	running := int64(0)
+	for _, p := range node.Pods {
+		if policyFor(p).bound.io {
+			running++
+		}
+	}
+	return maxNodeScore / (running + 1)
+}
+
+// leastAllocated favours the nodes with the most unrequested resources,
+// spreading pods across the cluster.
+type leastAllocated struct{}
+
+func (leastAllocated) Name() string { return "LeastAllocated" }
+
+func (leastAllocated) Score(pod *Pod, node *NodeInfo) (int64, error) {
+	allocated, err := allocatedScore(pod, node)
+	if err != nil {
+		return 0, err
+	}
+	return maxNodeScore - allocated, nil
+}
+
+// mostAllocated favours the nodes with the least unrequested resources,
+// bin packing pods on as few nodes as possible.
+type mostAllocated struct{}
+
+func (mostAllocated) Name() string { return "MostAllocated" }
+
+func (mostAllocated) Score(pod *Pod, node *NodeInfo) (int64, error) {
+	return allocatedScore(pod, node)
+}
+
+// allocatedScore returns the share of the node allocatable CPU and memory
+// which would be requested once the pod is bound, between 0 and
+// maxNodeScore.
+func allocatedScore(pod *Pod, node *NodeInfo) (int64, error) {
+	cpu, memory, err := podRequests(pod)
+	if err != nil {
+		return 0, err
+	}
+
+	allocatableCPU, err := milliCPU(node.Node.Status.Allocatable["cpu"])
+	if err != nil {
+		return 0, err
+	}
+	allocatableMemory, err := memoryBytes(node.Node.Status.Allocatable["memory"])
+	if err != nil {
+		return 0, err
+	}
+
+	return (share(node.RequestedCPU+cpu, allocatableCPU) + share(node.RequestedMemory+memory, allocatableMemory)) / 2, nil
+}
+
+func share(used, capacity int64) int64 {
+	if capacity <= 0 || used >= capacity {
+		return maxNodeScore
+	}
+	return used * maxNodeScore / capacity
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
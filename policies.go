@@ -0,0 +1,355 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	policyAPIVersion = "scheduling.k8s-resource-scheduler.io/v1alpha1"
+	policyKind       = "SchedulingPolicy"
+)
+
+// SchedulingPolicy sets how the pods of its namespace are scheduled, instead
+// of annotating every pod.
+type SchedulingPolicy struct {
+	ApiVersion string               `json:"apiVersion,omitempty"`
+	Kind       string               `json:"kind,omitempty"`
+	Metadata   Metadata             `json:"metadata"`
+	Spec       SchedulingPolicySpec `json:"spec"`
+}
+
+// SchedulingPolicySpec holds the settings of a policy. Unset fields fall
+// back to the cluster default policy, then to the scheduler configuration.
+type SchedulingPolicySpec struct {
+	// ScoreWeights are the weights of the score plugins, by name. They
+	// replace the weights of the profile, a plugin missing from it is
+	// added and a weight of 0 disables a plugin.
+	ScoreWeights map[string]int64 `json:"scoreWeights,omitempty"`
+	// Bound is the resource the pods are bound by: cpu, memory or io, as
+	// the cpu-bound, memory-bound and io-bound annotations.
+	Bound string `json:"bound,omitempty"`
+	// BurstProtectSeconds is the minimum time between two allocations, as
+	// the burst-protect annotation.
+	BurstProtectSeconds *int `json:"burstProtectSeconds,omitempty"`
+	// NodePools are the node pools the pods can run on, in order of
+	// preference, all when empty.
+	NodePools []string `json:"nodePools,omitempty"`
+	// MaxParallelJobs replaces the maxParallelJobs of the configuration.
+	MaxParallelJobs *int `json:"maxParallelJobs,omitempty"`
+	// Admission is the admission mode of the pods, requests or usage, as
+	// the admission of the profiles.
+	Admission string `json:"admission,omitempty"`
+}
+
+type SchedulingPolicyList struct {
+	Metadata ListMetadata       `json:"metadata"`
+	Items    []SchedulingPolicy `json:"items"`
+}
+
+type SchedulingPolicyWatchEvent struct {
+	Type   string           `json:"type"`
+	Object SchedulingPolicy `json:"object"`
+}
+
+var policies = &policyStore{}
+
+// policyStore holds the SchedulingPolicies of the cluster, kept up to date
+// by a watch.
+type policyStore struct {
+	sync.RWMutex
+	byKey    map[string]*SchedulingPolicy
+	lastSync time.Time
+}
+
+func policyKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// replace makes the policies the only ones known. The invalid settings are
+// reported on the policies when report is set.
+func (s *policyStore) replace(items []SchedulingPolicy, report bool) {
+	byKey := map[string]*SchedulingPolicy{}
+	for i := range items {
+		p, problems := checkPolicy(items[i])
+		if len(problems) != 0 && report {
+			reportInvalidPolicy(p, problems)
+		}
+		byKey[policyKey(p.Metadata.Namespace, p.Metadata.Name)] = &p
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.byKey = byKey
+	s.lastSync = time.Now()
+}
+
+// apply applies a change of the policies.
+func (s *policyStore) apply(event SchedulingPolicyWatchEvent) {
+	p := event.Object
+	key := policyKey(p.Metadata.Namespace, p.Metadata.Name)
+	if event.Type == "ADDED" || event.Type == "MODIFIED" {
+		var problems []string
+		p, problems = checkPolicy(p)
+		if len(problems) != 0 {
+			reportInvalidPolicy(p, problems)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.byKey == nil {
+		s.byKey = map[string]*SchedulingPolicy{}
+	}
+	switch event.Type {
+	case "ADDED", "MODIFIED":
+		s.byKey[key] = &p
+		logger.Debug("Scheduling policy updated", "policy", key)
+	case "DELETED":
+		delete(s.byKey, key)
+		logger.Debug("Scheduling policy deleted", "policy", key)
+	}
+}
+
+func (s *policyStore) synced() bool {
+	s.RLock()
+	defer s.RUnlock()
+	return !s.lastSync.IsZero()
+}
+
+// list returns the policies, sorted by namespace and name.
+func (s *policyStore) list() []SchedulingPolicy {
+	s.RLock()
+	defer s.RUnlock()
+	keys := []string{}
+	for k := range s.byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	items := make([]SchedulingPolicy, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, *s.byKey[k])
+	}
+	return items
+}
+
+// forNamespace returns the policy of the namespace, and the cluster default
+// policy named by key, nil when they don't exist. A namespace is expected to
+// have a single policy, the first one by name applies otherwise.
+func (s *policyStore) forNamespace(namespace, clusterDefault string) (*SchedulingPolicy, *SchedulingPolicy) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var own *SchedulingPolicy
+	for _, p := range s.byKey {
+		if p.Metadata.Namespace == namespace && (own == nil || p.Metadata.Name < own.Metadata.Name) {
+			own = p
+		}
+	}
+	return own, s.byKey[clusterDefault]
+}
+
+// run keeps the policies up to date until done is closed: they are listed,
+// then watched from the version listed, and listed again when the watch
+// ends.
+func (s *policyStore) run(done chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		err := s.sync(done)
+		select {
+		case <-done:
+			logger.Info("Stopped scheduling policies watch")
+			return
+		default:
+		}
+		if err == nil {
+			continue
+		}
+
+		logger.Warn("Scheduling policies watch failed", "err", err)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-done:
+			logger.Info("Stopped scheduling policies watch")
+			return
+		}
+	}
+}
+
+func (s *policyStore) sync(done chan struct{}) error {
+	list, err := listSchedulingPolicies()
+	if err != nil {
+		return err
+	}
+	s.replace(list.Items, true)
+	return watchSchedulingPolicies(list.Metadata.ResourceVersion, done, s.apply)
+}
+
+// checkPolicy returns the policy without its invalid settings, and the
+// problems found with them.
+func checkPolicy(p SchedulingPolicy) (SchedulingPolicy, []string) {
+	problems := []string{}
+	spec := &p.Spec
+
+	names := []string{}
+	for name := range spec.ScoreWeights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	weights := map[string]int64{}
+	for _, name := range names {
+		w := spec.ScoreWeights[name]
+		switch _, ok := scorePlugins[name]; {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("scoreWeights: unknown score plugin %q", name))
+		case w < 0:
+			problems = append(problems, fmt.Sprintf("scoreWeights: weight of %q must not be negative", name))
+		default:
+			weights[name] = w
+		}
+	}
+	spec.ScoreWeights = weights
+	if spec.Bound != "" && spec.Bound != "cpu" && spec.Bound != "memory" && spec.Bound != "io" {
+		problems = append(problems, fmt.Sprintf("bound: must be cpu, memory or io, got %q", spec.Bound))
+		spec.Bound = ""
+	}
+	if spec.BurstProtectSeconds != nil && *spec.BurstProtectSeconds < 0 {
+		problems = append(problems, "burstProtectSeconds: must not be negative")
+		spec.BurstProtectSeconds = nil
+	}
+	if spec.MaxParallelJobs != nil && *spec.MaxParallelJobs < 0 {
+		problems = append(problems, "maxParallelJobs: must not be negative")
+		spec.MaxParallelJobs = nil
+	}
+	if spec.Admission != "" && !validAdmissionMode(spec.Admission) {
+		problems = append(problems, fmt.Sprintf("admission: must be requests or usage, got %q", spec.Admission))
+		spec.Admission = ""
+	}
+
+	if len(problems) != 0 {
+		key := policyKey(p.Metadata.Namespace, p.Metadata.Name)
+		logger.Warn("Ignoring invalid scheduling policy settings", "policy", key, "problems", strings.Join(problems, "; "))
+	}
+	return p, problems
+}
+
+// reportInvalidPolicy posts a warning event on the policy with its invalid
+// settings.
+func reportInvalidPolicy(p SchedulingPolicy, problems []string) {
+	ref := ObjectReference{ApiVersion: policyAPIVersion, Kind: policyKind, Name: p.Metadata.Name, Namespace: p.Metadata.Namespace, Uid: p.Metadata.Uid}
+	err := recorder.record(schedulerName, ref, "Warning", "InvalidSchedulingPolicy", "Validating", "Ignoring invalid settings: "+strings.Join(problems, "; "))
+	if err != nil {
+		logger.Warn("Failed posting event", "err", err)
+	}
+}
+
+// resourceBound tells which resources a pod is bound by.
+type resourceBound struct {
+	cpu, memory, io bool
+}
+
+// podPolicy is the policy a pod is scheduled with.
+type podPolicy struct {
+	// weights are the score weights of the policies, nil when they set
+	// none.
+	weights      map[string]int64
+	bound        resourceBound
+	burstProtect int
+	// nodePools are the node pools the pod can run on, in order of
+	// preference, nil for all.
+	nodePools       []string
+	maxParallelJobs *int
+	// admission is the admission mode, empty when the policies set none.
+	admission string
+}
+
+// policyFor returns the policy the pod is scheduled with. For each setting,
+// the pod annotations take precedence over the policy of the pod namespace,
+// which takes precedence over the cluster default policy, which takes
+// precedence over the scheduler configuration. Score weights are merged by
+// plugin.
+func policyFor(pod *Pod) podPolicy {
+	own, clusterDefault := policies.forNamespace(pod.Metadata.Namespace, currentConfig().Policies.ClusterDefault)
+
+	pp := podPolicy{}
+	for _, p := range []*SchedulingPolicy{clusterDefault, own} {
+		if p == nil {
+			continue
+		}
+		spec := p.Spec
+		for name, w := range spec.ScoreWeights {
+			if pp.weights == nil {
+				pp.weights = map[string]int64{}
+			}
+			pp.weights[name] = w
+		}
+		if spec.Bound != "" {
+			pp.bound = resourceBound{cpu: spec.Bound == "cpu", memory: spec.Bound == "memory", io: spec.Bound == "io"}
+		}
+		if spec.BurstProtectSeconds != nil {
+			pp.burstProtect = *spec.BurstProtectSeconds
+		}
+		if len(spec.NodePools) != 0 {
+			pp.nodePools = spec.NodePools
+		}
+		if spec.MaxParallelJobs != nil {
+			pp.maxParallelJobs = spec.MaxParallelJobs
+		}
+		if spec.Admission != "" {
+			pp.admission = spec.Admission
+		}
+	}
+
+	// Any bound annotation replaces the bound of the policies.
+	if getProperty("cpu-bound", pod.Metadata) != "" || getProperty("memory-bound", pod.Metadata) != "" || getProperty("io-bound", pod.Metadata) != "" {
+		pp.bound = resourceBound{
+			cpu:    getPropertyBool("cpu-bound", pod.Metadata),
+			memory: getPropertyBool("memory-bound", pod.Metadata),
+			io:     getPropertyBool("io-bound", pod.Metadata),
+		}
+	}
+	if getProperty("burst-protect", pod.Metadata) != "" {
+		pp.burstProtect = getPropertyInt("burst-protect", pod.Metadata)
+	}
+	// The node-pools annotation orders the pools the policies allow, the
+	// others are ignored.
+	if annotation := getProperty("node-pools", pod.Metadata); annotation != "" {
+		preferred := []string{}
+		for _, name := range strings.Split(annotation, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" && !contains(preferred, name) && (len(pp.nodePools) == 0 || contains(pp.nodePools, name)) {
+				preferred = append(preferred, name)
+			}
+		}
+		if len(preferred) != 0 {
+			pp.nodePools = preferred
+		}
+	}
+	return pp
+}
+
+// checkPoliciesSynced fails until the policies are listed, when they are
+// enabled, so that no pod gets scheduled without its policy.
+func checkPoliciesSynced() error {
+	if currentConfig().Policies.Enabled && !policies.synced() {
+		return errors.New("scheduling policies not synced yet")
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// nodePoolLabel is the label holding the node pool of a node, for the pools
+// without selector.
+const nodePoolLabel = schedulerName + "/node-pool"
+
+func init() {
+	filterPlugins["NodePools"] = func(*Config) FilterPlugin { return nodePools{} }
+}
+
+// NodePool is the node pool of a node, shared by the NodeInfos of the nodes
+// of the pool.
+type NodePool struct {
+	NodePoolConfig
+	// RunningJobs is the number of running pods scheduled by us on the
+	// nodes of the pool.
+	RunningJobs int
+}
+
+// overcommitRatio returns the ratio the allocatable resources of the nodes
+// of the pool are multiplied by.
+func (p *NodePool) overcommitRatio() float64 {
+	if p.OvercommitRatio == 0 {
+		return 1
+	}
+	return p.OvercommitRatio
+}
+
+// matches tells whether the node belongs to the pool.
+func (p NodePoolConfig) matches(node *Node) bool {
+	labels := node.Metadata.Labels
+	if p.Selector == nil {
+		return labels[nodePoolLabel] == p.Name
+	}
+	for k, v := range p.Selector.MatchLabels {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return matchRequirements(p.Selector.MatchExpressions, labels)
+}
+
+// nodePoolOf returns the pool of the node: the first configured pool
+// matching it, else the pool named by its node-pool label, with the default
+// settings. The nodes in no pool are in the pool with no name.
+func nodePoolOf(cfg *Config, node *Node) NodePoolConfig {
+	for _, p := range cfg.NodePools {
+		if p.matches(node) {
+			return p
+		}
+	}
+	return NodePoolConfig{Name: node.Metadata.Labels[nodePoolLabel]}
+}
+
+// setNodePools sets the pool of the nodes, and counts the jobs running in
+// each pool.
+func setNodePools(cfg *Config, nodes []*NodeInfo) {
+	pools := map[string]*NodePool{}
+	for _, n := range nodes {
+		pc := nodePoolOf(cfg, n.Node)
+		pool, ok := pools[pc.Name]
+		if !ok {
+			pool = &NodePool{NodePoolConfig: pc}
+			pools[pc.Name] = pool
+		}
+		n.Pool = pool
+
+		for _, p := range n.Pods {
+			if p.Status.Phase == "Running" && cfg.ownsPod(p) {
+				pool.RunningJobs++
+			}
+		}
+	}
+}
+
+// nodePools rejects the nodes outside the node pools the policy of the pod
+// allows, and the nodes of the pools already running their maxParallelJobs.
+type nodePools struct{}
+
+func (nodePools) Name() string { return "NodePools" }
+
+func (nodePools) Filter(pod *Pod, node *NodeInfo) error {
+	allowed := policyFor(pod).nodePools
+	if len(allowed) != 0 && !contains(allowed, node.Pool.Name) {
+		return errors.New("node(s) not in the allowed node pools")
+	}
+	if limit := node.Pool.MaxParallelJobs; limit != 0 && node.Pool.RunningJobs >= limit {
+		return fmt.Errorf("node(s) in a node pool already running %d jobs", limit)
+	}
+	return nil
+}
+
+// preferNodePools keeps the feasible nodes of the pool the pod prefers most,
+// the pools it prefers less being fallbacks. The nodes of the pools it
+// doesn't list come last.
+func preferNodePools(pod *Pod, feasible []*NodeInfo, failures map[string]string) []*NodeInfo {
+	preferred := policyFor(pod).nodePools
+	if len(preferred) < 2 {
+		return feasible
+	}
+	rank := func(n *NodeInfo) int {
+		for i, name := range preferred {
+			if n.Pool.Name == name {
+				return i
+			}
+		}
+		return len(preferred)
+	}
+
+	best := len(preferred)
+	for _, n := range feasible {
+		if r := rank(n); r < best {
+			best = r
+		}
+	}
+	kept := []*NodeInfo{}
+	for _, n := range feasible {
+		if rank(n) == best {
+			kept = append(kept, n)
+		} else {
+			failures[n.Name()] = "NodePools: node(s) in a less preferred node pool"
+		}
+	}
+	return kept
+}
@@ -16,9 +16,8 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -26,41 +25,170 @@ import (
 var processorLock = &sync.Mutex{}
 var lastAllocation *time.Time
 
-func reconcileUnscheduledPods(interval int, done chan struct{}, wg *sync.WaitGroup) {
+// lockProcessor serialises the scheduling attempts. The time the lock is
+// taken is recorded, to detect a stuck scheduling loop.
+func lockProcessor() {
+	processorLock.Lock()
+	health.setProcessing(true)
+}
+
+func unlockProcessor() {
+	health.setProcessing(false)
+	processorLock.Unlock()
+}
+
+// Pods are retried through Queue. queuedPods tracks the sub-queue each of
+// them was put in: backoffQueue for the pods held back by the burst
+// protection, unschedulableQueue for the pods which didn't fit any node.
+const (
+	backoffQueue       = "backoff"
+	unschedulableQueue = "unschedulable"
+)
+
+var queueLock sync.Mutex
+var queuedPods = map[string]string{}
+
+// enqueue queues the pod for another attempt, unless it is already queued.
+func enqueue(pod *Pod, subQueue string) {
+	key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	queueLock.Lock()
+	_, queued := queuedPods[key]
+	queuedPods[key] = subQueue
+	queueLock.Unlock()
+
+	if !queued {
+		Queue <- pod
+	}
+}
+
+func dequeued(pod *Pod) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	delete(queuedPods, pod.Metadata.Namespace+"/"+pod.Metadata.Name)
+}
+
+// trackedPods are the unscheduled pods, by namespace/name, as last seen by the
+// pods watch or the reconciliation. Pods are forgotten once they are bound or
+// deleted, which drops their queued attempts.
+var trackedLock sync.Mutex
+var trackedPods = map[string]*Pod{}
+
+func trackPod(pod *Pod) {
+	trackedLock.Lock()
+	defer trackedLock.Unlock()
+	trackedPods[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = pod
+}
+
+// forgetPod stops tracking the pod, and removes it from the queue.
+func forgetPod(pod *Pod) {
+	key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	trackedLock.Lock()
+	delete(trackedPods, key)
+	trackedLock.Unlock()
+
+	queueLock.Lock()
+	delete(queuedPods, key)
+	queueLock.Unlock()
+}
+
+// trackedPod returns the last version seen of the pod, or nil if it has been
+// bound or deleted since.
+func trackedPod(pod *Pod) *Pod {
+	trackedLock.Lock()
+	defer trackedLock.Unlock()
+	p, ok := trackedPods[pod.Metadata.Namespace+"/"+pod.Metadata.Name]
+	if !ok || (pod.Metadata.Uid != "" && p.Metadata.Uid != pod.Metadata.Uid) {
+		// A pod recreated with the same name is another pod.
+		return nil
+	}
+	return p
+}
+
+// queueDepths returns the number of pods in each sub-queue.
+func queueDepths() map[string]float64 {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	depths := map[string]float64{backoffQueue: 0, unschedulableQueue: 0}
+	for _, q := range queuedPods {
+		depths[q]++
+	}
+	return depths
+}
+
+func reconcileUnscheduledPods(interval time.Duration, done chan struct{}, wg *sync.WaitGroup) {
 	for {
 		select {
-		case <-time.After(time.Duration(interval) * time.Second):
-			err := schedulePods()
+		case <-time.After(interval):
+			err := schedulePods(done)
 			if err != nil {
-				log.Println(err)
+				logger.Error("Failed listing unscheduled pods", "err", err)
 			}
 		case <-done:
 			wg.Done()
-			log.Println("Stopped reconciliation loop.")
+			logger.Info("Stopped reconciliation loop")
 			return
 		}
 	}
 }
 
+// monitorUnscheduledPods schedules the unscheduled pods of our profiles as
+// they are created. The watch is restarted when the scheduler names served
+// change.
 func monitorUnscheduledPods(done chan struct{}, wg *sync.WaitGroup) {
-	pods, errc := watchUnscheduledPods()
+	for {
+		changed := schedulerNamesChanged()
+		names := currentConfig().schedulerNames()
+		stop := make(chan struct{})
+		events, errc := watchUnscheduledPods(names, stop)
+		logger.Debug("Watching unscheduled pods", "schedulerNames", strings.Join(names, ","))
 
+		restart := handlePodEvents(events, errc, changed, done)
+		close(stop)
+		if !restart {
+			wg.Done()
+			logger.Info("Stopped scheduler")
+			return
+		}
+		logger.Info("Scheduler names changed, restarting the pods watch")
+	}
+}
+
+// handlePodEvents tracks the unscheduled pods and schedules the new ones,
+// until done is closed or the scheduler names change, in which case it
+// returns true.
+func handlePodEvents(events <-chan PodWatchEvent, errc <-chan error, changed <-chan struct{}, done chan struct{}) bool {
 	for {
 		select {
 		case err := <-errc:
-			log.Println(err)
-		case pod := <-pods:
-			processorLock.Lock()
-			time.Sleep(2 * time.Second)
-			err := schedulePod(&pod)
-			if err != nil {
-				log.Println(err)
+			logger.Warn("Pods watch failed", "err", err)
+		case event := <-events:
+			pod := event.Object
+			switch {
+			case !currentConfig().ownsPod(&pod):
+				forgetPod(&pod)
+				continue
+			case event.Type == "DELETED" || pod.Spec.NodeName != "":
+				// Deleted, or bound: the pod no longer matches the
+				// watch.
+				forgetPod(&pod)
+				continue
+			case event.Type == "MODIFIED":
+				if trackedPod(&pod) != nil {
+					trackPod(&pod)
+				}
+				continue
 			}
-			processorLock.Unlock()
+
+			trackPod(&pod)
+			lockProcessor()
+			time.Sleep(2 * time.Second)
+			schedulePod(&pod)
+			unlockProcessor()
+		case <-changed:
+			return true
 		case <-done:
-			wg.Done()
-			log.Println("Stopped scheduler.")
-			return
+			return false
 		}
 	}
 }
@@ -82,102 +210,182 @@ func scheduleQueue(done chan struct{}, queue chan *Pod, wg *sync.WaitGroup) {
 	for {
 		select {
 		case pod := <-queue:
-			processorLock.Lock()
-			time.Sleep(2 * time.Second)
-			err := schedulePod(pod)
-			if err != nil {
-				log.Println(err)
+			dequeued(pod)
+			pod = trackedPod(pod)
+			if pod == nil {
+				// Bound or deleted while queued.
+				continue
 			}
-			processorLock.Unlock()
+			lockProcessor()
+			time.Sleep(2 * time.Second)
+			schedulePod(pod)
+			unlockProcessor()
 		case <-done:
 			wg.Done()
-			log.Println("Stopped scheduler.")
+			logger.Info("Stopped scheduler")
 			return
 		}
 	}
 }
 
-func schedulePod(pod *Pod) error {
+// schedulePod tries to bind the pod to the best node, and queues it again
+// if it can't be scheduled yet. The outcome is logged, and returned.
+func schedulePod(pod *Pod) (err error) {
 	now := time.Now()
+	profile := frameworkFor(pod).profile
+	log := attemptLogger(pod).With("profile", profile)
 
-	burstProtect := getPropertyInt("burst-protect", pod.Metadata)
+	latest := trackedPod(pod)
+	if latest == nil {
+		log.Debug("Pod bound or deleted meanwhile, dropped")
+		return nil
+	}
+	pod = latest
+	if !currentConfig().ownsPod(pod) {
+		// Its profile was removed since it got queued.
+		log.Info("Pod not handled by our profiles anymore, dropped", "schedulerName", pod.Spec.SchedulerName)
+		forgetPod(pod)
+		return nil
+	}
+
+	burstProtect := policyFor(pod).burstProtect
 	if lastAllocation != nil && burstProtect != 0 {
 		diff := now.Sub(*lastAllocation)
 		if diff.Seconds() < float64(burstProtect) {
-			Queue <- pod
+			log.Info("Burst detected, waiting", "sinceLastAllocation", diff.Seconds(), "burstProtect", burstProtect)
+			enqueue(pod, backoffQueue)
 			return fmt.Errorf("burst detected for pod '%s' - waiting (diff: %f burst: %f)", pod.Metadata.Name, diff.Seconds(), float64(burstProtect))
 		}
 	}
 
-	nodes, err := fit(pod)
-	if err != nil {
-		return err
-	}
-
-	if os.Getenv("MAX_PARALLEL_JOBS") != "" {
-		fmt.Println("Max parallel jobs defined")
-		threshold := 2
-
-		t, err := strconv.Atoi(os.Getenv("MAX_PARALLEL_JOBS"))
-		if err == nil {
-			threshold = t
+	log.Debug("Scheduling attempt started")
+	result := "error"
+	var fr *fitResult
+	var scores []NodeScore
+	var selected string
+	defer func() {
+		scheduleAttempts.inc(result, profile)
+		e2eSchedulingDuration.since(now, result)
+		switch {
+		case err == nil:
+		case result == "unschedulable":
+			log.Info("Pod unschedulable, queued for retry", "err", err)
+		case result == "aborted":
+			log.Info("Leadership lost, pod left to the new leader")
+			return
+		default:
+			log.Error("Scheduling attempt failed", "err", err)
 		}
 
-		pods, _ := getRunningPods()
-		runningJobs := map[string]int{}
-		for _, p := range pods {
-			runningJobs[p.Spec.NodeName]++
+		if fr == nil {
+			return
 		}
-		fmt.Println(runningJobs)
-
-		realNodes := []Node{}
-		for _, n := range nodes {
-			if runningJobs[n.Metadata.Name] < threshold {
-				realNodes = append(realNodes, n)
-			} else {
-				fmt.Println("Filtering", n.Metadata.Name, "Jobs running", runningJobs[n.Metadata.Name], "Threshold", threshold)
-			}
+		d := newDecision(profile, fr, scores, selected)
+		if result == "scheduled" || result == "unschedulable" {
+			recordDecision(log, pod, d)
 		}
+		audit(log, newAuditRecord(pod, d, fr, result, err))
+	}()
 
-		nodes = realNodes
+	start := time.Now()
+	fr, err = fit(log, pod)
+	schedulingPhaseDuration.since(start, "fit")
+	if err != nil {
+		return err
 	}
 
-	if len(nodes) == 0 {
-		Queue <- pod
+	if len(fr.feasible) == 0 {
+		summary := failureSummary(len(fr.nodes), fr.failures)
+		err := postFailedScheduling(pod, profile, summary)
+		if err != nil {
+			log.Warn("Failed posting event", "err", err)
+		}
+		err = updatePodScheduled(pod, "False", "Unschedulable", summary)
+		if err != nil {
+			log.Warn("Failed updating the PodScheduled condition", "err", err)
+		}
+		result = "unschedulable"
+		enqueue(pod, unschedulableQueue)
 		return fmt.Errorf("Unable to schedule pod (%s) failed to fit in any node", pod.Metadata.Name)
 	}
 
-	node, err := bestNode(pod, nodes)
+	start = time.Now()
+	node, scores, err := bestNode(log, pod, fr.feasible)
+	schedulingPhaseDuration.since(start, "score")
 	if err != nil {
 		return err
 	}
 
 	if node == nil {
-		Queue <- pod
+		result = "unschedulable"
+		enqueue(pod, unschedulableQueue)
 		return fmt.Errorf("no available node to fit pod %s", pod.Metadata.Name)
 	}
 
-	err = bind(pod, *node)
+	selected = node.Name()
+	if !leading() {
+		// A standby may have taken over already, it binds the pod and
+		// records the decision.
+		result = "aborted"
+		return errNotLeader
+	}
+	start = time.Now()
+	err = bindVolumes(log, pod, node)
+	if err == nil {
+		err = bind(log, pod, node.Node)
+	}
+	schedulingPhaseDuration.since(start, "bind")
+	if err == errPodGone || err == errAlreadyBound {
+		// Bound by another attempt, or deleted, since we fetched it:
+		// there is nothing left to schedule.
+		result = "dropped"
+		forgetPod(pod)
+		log.Info("Pod dropped", "reason", err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
+	result = "scheduled"
+	forgetPod(pod)
+	cache.assume(pod, node.Name())
 	lastAllocation = &now
+	err = assumedUsage.assume(node.Name(), pod, time.Now())
+	if err != nil {
+		log.Warn("Failed assuming the pod usage", "err", err)
+	}
+
+	err = updatePodScheduled(pod, "True", "", "")
+	if err != nil {
+		log.Warn("Failed updating the PodScheduled condition", "err", err)
+	}
 	return nil
 }
 
-func schedulePods() error {
-	processorLock.Lock()
-	defer processorLock.Unlock()
+// schedulePods schedules the unscheduled pods of our profiles, one after the
+// other, until done is closed or the leadership is lost. The lock is taken
+// for each pod, so that a long list doesn't look like a stuck loop.
+func schedulePods(done chan struct{}) error {
 	pods, err := getUnscheduledPods()
 	if err != nil {
 		return err
 	}
 	for _, pod := range pods {
-		err := schedulePod(pod)
-		if err != nil {
-			log.Println(err)
+		select {
+		case <-done:
+			return nil
+		default:
 		}
+		if !leading() {
+			logger.Info("Leadership lost, stopped scheduling unscheduled pods")
+			return nil
+		}
+
+		trackPod(pod)
+		lockProcessor()
+		schedulePod(pod)
+		unlockProcessor()
 	}
 	return nil
 }
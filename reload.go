@@ -0,0 +1,222 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configReloader applies the configurations changed at runtime. Profiles,
+// plugins, weights and limits are reloaded without touching the scheduling
+// queue, while the settings the scheduler was started with (API connection,
+// workers, queue, intervals, audit sinks, policies watch, leader election,
+// HTTP server) are kept until a restart.
+type configReloader struct {
+	sync.Mutex
+	args []string
+	last string
+}
+
+// reload applies the configuration b, read from source, if it changed since
+// the last call. Invalid configurations are rejected and the current one is
+// kept.
+func (r *configReloader) reload(source string, b []byte) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if string(b) == r.last {
+		return nil
+	}
+	r.last = string(b)
+
+	cfg, err := parseConfigData(source, b, r.args)
+	if err != nil {
+		return err
+	}
+
+	current := currentConfig()
+	if static := keepStaticConfig(cfg, current); len(static) != 0 {
+		logger.Warn("Configuration changes need a restart, ignoring them", "settings", strings.Join(static, ","))
+	}
+
+	err = applyConfig(cfg)
+	if err != nil {
+		return err
+	}
+	logger.Info("Applied new configuration", "source", source)
+	return nil
+}
+
+// keepStaticConfig copies the settings which can't be changed at runtime
+// from current to cfg, and returns the ones which differed.
+func keepStaticConfig(cfg, current *Config) []string {
+	changed := []string{}
+	if cfg.API != current.API {
+		changed = append(changed, "api")
+		cfg.API = current.API
+	}
+	if cfg.BindAddress != current.BindAddress {
+		changed = append(changed, "bindAddress")
+		cfg.BindAddress = current.BindAddress
+	}
+	if cfg.Shadow != current.Shadow {
+		changed = append(changed, "shadow")
+		cfg.Shadow = current.Shadow
+	}
+	if cfg.Workers != current.Workers {
+		changed = append(changed, "workers")
+		cfg.Workers = current.Workers
+	}
+	if cfg.QueueSize != current.QueueSize {
+		changed = append(changed, "queueSize")
+		cfg.QueueSize = current.QueueSize
+	}
+	if cfg.ReconcileInterval != current.ReconcileInterval {
+		changed = append(changed, "reconcileInterval")
+		cfg.ReconcileInterval = current.ReconcileInterval
+	}
+	if cfg.CacheRefreshInterval != current.CacheRefreshInterval {
+		changed = append(changed, "cacheRefreshInterval")
+		cfg.CacheRefreshInterval = current.CacheRefreshInterval
+	}
+	if cfg.Audit != current.Audit {
+		changed = append(changed, "audit")
+		cfg.Audit = current.Audit
+	}
+	if cfg.Extender.BindAddress != current.Extender.BindAddress {
+		changed = append(changed, "extender.bindAddress")
+		cfg.Extender.BindAddress = current.Extender.BindAddress
+	}
+	if cfg.Policies.Enabled != current.Policies.Enabled {
+		changed = append(changed, "policies.enabled")
+		cfg.Policies.Enabled = current.Policies.Enabled
+	}
+	if cfg.UsageHistory.Enabled != current.UsageHistory.Enabled {
+		changed = append(changed, "usageHistory.enabled")
+		cfg.UsageHistory.Enabled = current.UsageHistory.Enabled
+	}
+	if cfg.UsageHistory.Interval != current.UsageHistory.Interval {
+		changed = append(changed, "usageHistory.interval")
+		cfg.UsageHistory.Interval = current.UsageHistory.Interval
+	}
+	if cfg.LeaderElection != current.LeaderElection {
+		changed = append(changed, "leaderElection")
+		cfg.LeaderElection = current.LeaderElection
+	}
+	if cfg.Reload != current.Reload {
+		changed = append(changed, "reload")
+		cfg.Reload = current.Reload
+	}
+	return changed
+}
+
+// watchFile reloads the configuration file every time its content changes.
+// Mounted ConfigMaps are updated in place by the kubelet.
+func (r *configReloader) watchFile(path string, interval time.Duration, done chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		r.Lock()
+		r.last = string(b)
+		r.Unlock()
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				logger.Warn("Failed reading configuration", "err", err)
+				continue
+			}
+
+			err = r.reload(path, b)
+			if err != nil {
+				r.reject(err, podReference())
+			}
+		case <-done:
+			logger.Info("Stopped configuration file watch")
+			return
+		}
+	}
+}
+
+// watchConfigMap reloads the configuration stored at key in the ConfigMap
+// every time it changes.
+func (r *configReloader) watchConfigMap(namespacedName, key string, done chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	parts := strings.SplitN(namespacedName, "/", 2)
+	configMaps, errc := watchConfigMap(parts[0], parts[1], done)
+
+	for {
+		select {
+		case err := <-errc:
+			logger.Warn("ConfigMap watch failed", "err", err)
+		case cm := <-configMaps:
+			ref := &ObjectReference{
+				ApiVersion: "v1",
+				Kind:       "ConfigMap",
+				Name:       cm.Metadata.Name,
+				Namespace:  cm.Metadata.Namespace,
+				Uid:        cm.Metadata.Uid,
+			}
+
+			data, ok := cm.Data[key]
+			if !ok {
+				r.reject(fmt.Errorf("configmap %s has no %s key", namespacedName, key), ref)
+				continue
+			}
+
+			err := r.reload("configmap "+namespacedName, []byte(data))
+			if err != nil {
+				r.reject(err, ref)
+			}
+		case <-done:
+			logger.Info("Stopped configuration ConfigMap watch")
+			return
+		}
+	}
+}
+
+// reject reports an invalid configuration, with an event on the given
+// object if any.
+func (r *configReloader) reject(err error, object *ObjectReference) {
+	message := fmt.Sprintf("Rejected invalid configuration, keeping the current one: %s", err.Error())
+	logger.Error("Rejected invalid configuration, keeping the current one", "err", err)
+	if object == nil {
+		return
+	}
+
+	err = recorder.record(schedulerName, *object, "Warning", "InvalidConfiguration", "Reloading", message)
+	if err != nil {
+		logger.Warn("Failed posting event", "err", err)
+	}
+}
+
+// podReference returns a reference to the scheduler pod, from the POD_NAME
+// and POD_NAMESPACE environment variables, or nil if they are not set.
+func podReference() *ObjectReference {
+	name, namespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE")
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &ObjectReference{ApiVersion: "v1", Kind: "Pod", Name: name, Namespace: namespace}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var quantitySuffixes = []struct {
+	suffix     string
+	multiplier float64
+}{
+	// Binary suffixes go first, so that "Mi" is not taken for "i" after "M".
+	{"Ki", 1 << 10},
+	{"Mi", 1 << 20},
+	{"Gi", 1 << 30},
+	{"Ti", 1 << 40},
+	{"Pi", 1 << 50},
+	{"Ei", 1 << 60},
+	{"n", 1e-9},
+	{"u", 1e-6},
+	{"m", 1e-3},
+	{"k", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+	{"T", 1e12},
+	{"P", 1e15},
+	{"E", 1e18},
+}
+
+// parseQuantity parses a Kubernetes resource quantity (e.g. "500m", "1.5",
+// "128Mi", "250000n") into its value in base units (cores, bytes).
+func parseQuantity(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	multiplier := 1.0
+	for _, q := range quantitySuffixes {
+		if strings.HasSuffix(s, q.suffix) {
+			s = strings.TrimSuffix(s, q.suffix)
+			multiplier = q.multiplier
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return v * multiplier, nil
+}
+
+// milliCPU parses a CPU quantity into millicores.
+func milliCPU(s string) (int64, error) {
+	v, err := parseQuantity(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v * 1000), nil
+}
+
+// memoryBytes parses a memory quantity into bytes.
+func memoryBytes(s string) (int64, error) {
+	v, err := parseQuantity(s)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v), nil
+}
+
+// podRequests returns the CPU (in millicores) and memory (in bytes) requested
+// by all the containers of the pod.
+func podRequests(pod *Pod) (cpu int64, memory int64, err error) {
+	for _, c := range pod.Spec.Containers {
+		containerCPU, err := milliCPU(c.Resources.Requests["cpu"])
+		if err != nil {
+			return 0, 0, err
+		}
+		containerMemory, err := memoryBytes(c.Resources.Requests["memory"])
+		if err != nil {
+			return 0, 0, err
+		}
+		cpu += containerCPU
+		memory += containerMemory
+	}
+	return cpu, memory, nil
+}
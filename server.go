@@ -0,0 +1,55 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serveHTTP serves the scheduler endpoints on addr until done is closed.
+func serveHTTP(addr string, done chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/leader", leaderHandler)
+
+	logger.Info("Serving metrics and health checks", "address", addr)
+	err := listenAndServe(&http.Server{Addr: addr, Handler: mux}, done)
+	if err != nil {
+		logger.Error("HTTP server failed", "err", err)
+	}
+}
+
+// listenAndServe runs the server until done is closed, then shuts it down
+// gracefully.
+func listenAndServe(server *http.Server, done chan struct{}) error {
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	err := server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+// runShadow watches all the pods, whatever their scheduler, and compares
+// where they got bound with where we would have placed them, until stop is
+// closed. Nothing is bound, and no events are emitted.
+func runShadow(stop chan struct{}) {
+	events, errc := watchPods("", stop)
+
+	// pending are the pods seen unscheduled, by UID. Only those are
+	// compared, the pods already bound when we started are not.
+	pending := map[string]bool{}
+
+	for {
+		select {
+		case err := <-errc:
+			logger.Warn("Pods watch failed", "err", err)
+		case event := <-events:
+			pod := event.Object
+			uid := pod.Metadata.Uid
+			switch {
+			case event.Type == "DELETED":
+				delete(pending, uid)
+			case pod.Spec.NodeName == "":
+				pending[uid] = true
+			case pending[uid]:
+				delete(pending, uid)
+				lockProcessor()
+				shadowPod(&pod)
+				unlockProcessor()
+			}
+		case <-stop:
+			logger.Info("Stopped shadow scheduler")
+			return
+		}
+	}
+}
+
+// shadowPod computes where the pod, already bound to a node, would have been
+// placed, and reports whether it is the same node.
+func shadowPod(pod *Pod) {
+	profile := frameworkFor(pod).profile
+	actual := pod.Spec.NodeName
+	log := attemptLogger(pod).With("profile", profile, "scheduler", pod.Spec.SchedulerName, "actual", actual)
+
+	fr, err := fit(log, pod)
+	if err != nil {
+		shadowDecisions.inc("error", pod.Spec.SchedulerName)
+		log.Error("Shadow scheduling failed", "err", err)
+		return
+	}
+
+	if len(fr.feasible) == 0 {
+		shadowDecisions.inc("unschedulable", pod.Spec.SchedulerName)
+		log.Info("Shadow scheduling disagrees, pod fits no node", "actualRejection", fr.failures[actual])
+		return
+	}
+
+	node, scores, err := bestNode(log, pod, fr.feasible)
+	if err != nil {
+		shadowDecisions.inc("error", pod.Spec.SchedulerName)
+		log.Error("Shadow scheduling failed", "err", err)
+		return
+	}
+
+	if node.Name() == actual {
+		shadowDecisions.inc("agree", pod.Spec.SchedulerName)
+		log.Info("Shadow scheduling agrees", "node", node.Name())
+		return
+	}
+
+	keysAndValues := []interface{}{"node", node.Name()}
+	for _, s := range scores {
+		if s.Node == node.Name() {
+			keysAndValues = append(keysAndValues, "score", s.Score)
+		}
+		if s.Node == actual {
+			keysAndValues = append(keysAndValues, "actualScore", s.Score)
+		}
+	}
+	if reason, ok := fr.failures[actual]; ok {
+		keysAndValues = append(keysAndValues, "actualRejection", reason)
+	}
+	shadowDecisions.inc("disagree", pod.Spec.SchedulerName)
+	log.Info("Shadow scheduling disagrees", keysAndValues...)
+}
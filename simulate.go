@@ -0,0 +1,292 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// SimulationReport is the outcome of a simulation: where the incoming pods
+// were placed, the ones which could not be, and the utilisation of the
+// nodes after each step. Step 0 is the initial state, step n the state after
+// the n-th incoming pod.
+type SimulationReport struct {
+	Placements    []SimulatedPod      `json:"placements"`
+	Unschedulable []SimulatedPod      `json:"unschedulable"`
+	Utilisation   []UtilisationSample `json:"utilisation"`
+}
+
+type SimulatedPod struct {
+	Step      int      `json:"step"`
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Node      string   `json:"node,omitempty"`
+	Decision  Decision `json:"decision"`
+}
+
+type UtilisationSample struct {
+	Step  int               `json:"step"`
+	Nodes []NodeUtilisation `json:"nodes"`
+}
+
+// NodeUtilisation is the percentage of the allocatable resources of a node
+// requested by its pods, and used according to its metrics.
+type NodeUtilisation struct {
+	Node            string  `json:"node"`
+	CPURequested    float64 `json:"cpuRequested"`
+	MemoryRequested float64 `json:"memoryRequested"`
+	CPUUsed         float64 `json:"cpuUsed"`
+	MemoryUsed      float64 `json:"memoryUsed"`
+}
+
+// simulate schedules the incoming pods of the snapshot one after the other
+// with the configuration in use and the policies of the snapshot, without an
+// API server. Each placed pod counts as running on its node for the next
+// ones, and its requests are added to the node usage.
+func simulate(log *Logger, s *ClusterSnapshot) (*SimulationReport, error) {
+	nodes := s.Nodes
+	pods := []Pod{}
+	for _, p := range s.Pods {
+		if p.Status.Phase != "Succeeded" && p.Status.Phase != "Failed" {
+			pods = append(pods, p)
+		}
+	}
+	policies.replace(s.SchedulingPolicies, false)
+	volumes := newVolumeState(&s.ClusterVolumes)
+	report := &SimulationReport{Placements: []SimulatedPod{}, Unschedulable: []SimulatedPod{}}
+
+	infos, err := newNodeInfos(nodes, pods, volumes)
+	if err != nil {
+		return nil, err
+	}
+	report.Utilisation = append(report.Utilisation, utilisationSample(0, infos))
+
+	for i := range s.Incoming {
+		step := i + 1
+		pod := s.Incoming[i]
+		profile := frameworkFor(&pod).profile
+		podLog := log.With("step", step, "namespace", pod.Metadata.Namespace, "pod", pod.Metadata.Name, "profile", profile)
+
+		infos, err := newNodeInfos(nodes, pods, volumes)
+		if err != nil {
+			return nil, err
+		}
+		feasible, failures := frameworkFor(&pod).filter(podLog, &pod, infos)
+		fr := &fitResult{nodes: infos, feasible: feasible, failures: failures}
+
+		var node *NodeInfo
+		var scores []NodeScore
+		if len(feasible) != 0 {
+			node, scores, err = bestNode(podLog, &pod, feasible)
+			if err != nil {
+				return nil, fmt.Errorf("pod %s/%s: %s", pod.Metadata.Namespace, pod.Metadata.Name, err.Error())
+			}
+		}
+
+		result := SimulatedPod{Step: step, Namespace: pod.Metadata.Namespace, Name: pod.Metadata.Name}
+		if node == nil {
+			result.Decision = newDecision(profile, fr, scores, "")
+			report.Unschedulable = append(report.Unschedulable, result)
+			podLog.Debug("Pod unschedulable")
+		} else {
+			result.Node = node.Name()
+			result.Decision = newDecision(profile, fr, scores, node.Name())
+			report.Placements = append(report.Placements, result)
+			podLog.Debug("Pod placed", "node", node.Name())
+
+			err := addUsage(node.Node, &pod)
+			if err != nil {
+				return nil, err
+			}
+			pod.Spec.NodeName = node.Name()
+			pod.Status.Phase = "Running"
+			pods = append(pods, pod)
+			// The volumes reserved for its claims are not available
+			// to the next pods.
+			if podVolumes, err := volumes.podVolumes(&pod); err == nil {
+				if matched, ok := volumes.matchVolumes(podVolumes, node.Node); ok {
+					volumes = volumes.reserve(matched)
+				}
+			}
+		}
+
+		infos, err = newNodeInfos(nodes, pods, volumes)
+		if err != nil {
+			return nil, err
+		}
+		report.Utilisation = append(report.Utilisation, utilisationSample(step, infos))
+	}
+
+	return report, nil
+}
+
+// addUsage adds the requests of the pod to the usage of the node, if the
+// node has metrics.
+func addUsage(node *Node, pod *Pod) error {
+	usage := &node.NodeMetrics.Usage
+	if usage.Cpu == "" || usage.Memory == "" {
+		return nil
+	}
+
+	cpu, memory, err := podRequests(pod)
+	if err != nil {
+		return err
+	}
+	usedCPU, err := milliCPU(usage.Cpu)
+	if err != nil {
+		return err
+	}
+	usedMemory, err := memoryBytes(usage.Memory)
+	if err != nil {
+		return err
+	}
+
+	usage.Cpu = fmt.Sprintf("%dm", usedCPU+cpu)
+	usage.Memory = fmt.Sprintf("%d", usedMemory+memory)
+	return nil
+}
+
+func utilisationSample(step int, infos []*NodeInfo) UtilisationSample {
+	sample := UtilisationSample{Step: step, Nodes: make([]NodeUtilisation, 0, len(infos))}
+	for _, n := range infos {
+		allocatableCPU, _ := milliCPU(n.Node.Status.Allocatable["cpu"])
+		allocatableMemory, _ := memoryBytes(n.Node.Status.Allocatable["memory"])
+		usedCPU, _ := milliCPU(n.Node.NodeMetrics.Usage.Cpu)
+		usedMemory, _ := memoryBytes(n.Node.NodeMetrics.Usage.Memory)
+
+		sample.Nodes = append(sample.Nodes, NodeUtilisation{
+			Node:            n.Name(),
+			CPURequested:    percent(n.RequestedCPU, allocatableCPU),
+			MemoryRequested: percent(n.RequestedMemory, allocatableMemory),
+			CPUUsed:         percent(usedCPU, allocatableCPU),
+			MemoryUsed:      percent(usedMemory, allocatableMemory),
+		})
+	}
+	return sample
+}
+
+// percent returns used as a percentage of capacity, rounded to one decimal.
+func percent(used, capacity int64) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	return math.Round(float64(used)/float64(capacity)*1000) / 10
+}
+
+// simulateCommand implements the simulate subcommand: it replays the
+// snapshot given with --snapshot with the configuration from --config, the
+// snapshot itself or the defaults, overridden by the command line flags.
+func simulateCommand(args []string) int {
+	var snapshotPath, output string
+	extra := func(fs *flag.FlagSet) {
+		fs.StringVar(&snapshotPath, "snapshot", "", "Path of the cluster snapshot to simulate, in YAML or JSON")
+		fs.StringVar(&output, "output", "text", "Format of the simulation report: text or json")
+	}
+
+	cfg, err := parseConfig(args, extra)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err == nil && cfg == nil {
+		// --print-default-config
+		return 0
+	}
+	if err == nil && snapshotPath == "" {
+		err = errors.New("--snapshot is required")
+	}
+	if err == nil && output != "text" && output != "json" {
+		err = fmt.Errorf("unknown output format %q", output)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	snapshot, err := loadSnapshot(snapshotPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	b, err := snapshot.snapshotConfig()
+	if err == nil && b != nil && cfg.file == "" {
+		cfg, err = parseConfigData(snapshotPath+": config", b, args, extra)
+	}
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	report, err := simulate(logger, snapshot)
+	if err != nil {
+		logger.Error("Simulation failed", "err", err)
+		return 1
+	}
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.writeText(os.Stdout)
+	}
+	if err != nil {
+		logger.Error("Failed writing the simulation report", "err", err)
+		return 1
+	}
+	return 0
+}
+
+// writeText writes the report as tables.
+func (r *SimulationReport) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "PLACEMENTS")
+	fmt.Fprintln(tw, "STEP\tPOD\tNODE\tSCORE")
+	for _, p := range r.Placements {
+		fmt.Fprintf(tw, "%d\t%s/%s\t%s\t%d\n", p.Step, p.Namespace, p.Name, p.Node, p.Decision.Ranking[0].Score)
+	}
+
+	fmt.Fprintln(tw, "\nUNSCHEDULABLE")
+	fmt.Fprintln(tw, "STEP\tPOD\tREASONS")
+	for _, p := range r.Unschedulable {
+		reasons := []string{}
+		for node, reason := range p.Decision.Rejected {
+			reasons = append(reasons, node+": "+reason)
+		}
+		sort.Strings(reasons)
+		fmt.Fprintf(tw, "%d\t%s/%s\t%s\n", p.Step, p.Namespace, p.Name, strings.Join(reasons, "; "))
+	}
+
+	fmt.Fprintln(tw, "\nUTILISATION (%)")
+	fmt.Fprintln(tw, "STEP\tNODE\tCPU REQUESTED\tMEMORY REQUESTED\tCPU USED\tMEMORY USED")
+	for _, s := range r.Utilisation {
+		for _, n := range s.Nodes {
+			fmt.Fprintf(tw, "%d\t%s\t%.1f\t%.1f\t%.1f\t%.1f\n", s.Step, n.Node, n.CPURequested, n.MemoryRequested, n.CPUUsed, n.MemoryUsed)
+		}
+	}
+	return tw.Flush()
+}
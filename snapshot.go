@@ -0,0 +1,449 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const snapshotKind = "ClusterSnapshot"
+
+// ClusterSnapshot is the state of a cluster, as replayed by the simulate
+// subcommand. Nodes and pods are in the format of the Kubernetes API.
+type ClusterSnapshot struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	Nodes []*Node `json:"nodes"`
+	// NodeMetrics are the usage metrics of the nodes, matched by name.
+	NodeMetrics []NodeMetrics `json:"nodeMetrics,omitempty"`
+	// Pods are the pods already in the cluster, only the bound ones count.
+	Pods []Pod `json:"pods,omitempty"`
+	// Incoming are the pods to schedule, in order.
+	Incoming []Pod `json:"incoming,omitempty"`
+	// ClusterVolumes are the claims, volumes, storage classes and CSI
+	// nodes the volumes of the pods depend on.
+	ClusterVolumes
+	// SchedulingPolicies are the policies of the namespaces.
+	SchedulingPolicies []SchedulingPolicy `json:"schedulingPolicies,omitempty"`
+
+	// Config is the scheduler configuration, a SchedulerConfiguration.
+	Config interface{} `json:"config,omitempty"`
+}
+
+// loadSnapshot reads a cluster snapshot, in YAML or JSON.
+func loadSnapshot(path string) (*ClusterSnapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Kubernetes types only have JSON tags: the YAML is converted to
+	// JSON first. JSON is valid YAML.
+	var doc interface{}
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	b, err = json.Marshal(jsonCompatible(doc))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	s := &ClusterSnapshot{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if s.APIVersion != configAPIVersion || s.Kind != snapshotKind {
+		return nil, fmt.Errorf("%s: expected a %s %s, got %s %s", path, configAPIVersion, snapshotKind, s.APIVersion, s.Kind)
+	}
+
+	metrics := map[string]NodeMetrics{}
+	for _, m := range s.NodeMetrics {
+		metrics[m.Metadata.Name] = m
+	}
+	for _, n := range s.Nodes {
+		n.NodeMetrics = metrics[n.Metadata.Name]
+	}
+	return s, nil
+}
+
+// snapshotConfig returns the scheduler configuration of the snapshot as
+// YAML, or nil if it has none.
+func (s *ClusterSnapshot) snapshotConfig() ([]byte, error) {
+	if s.Config == nil {
+		return nil, nil
+	}
+	return yaml.Marshal(s.Config)
+}
+
+// jsonCompatible replaces the map[interface{}]interface{} decoded by yaml.v2
+// with map[string]interface{}, which can be encoded to JSON.
+func jsonCompatible(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, e := range value {
+			m[fmt.Sprint(k)] = jsonCompatible(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range value {
+			value[i] = jsonCompatible(e)
+		}
+		return value
+	default:
+		return v
+	}
+}
+
+// captureSnapshot reads the state of the cluster as the scheduler sees it:
+// the nodes with their metrics, the active pods, the storage objects
+// their volumes depend on and the scheduling policies. The pending pods
+// of our profiles become the incoming pods. cfg is recorded in the snapshot.
+func captureSnapshot(cfg *Config) (*ClusterSnapshot, error) {
+	nodeList, err := getNodes()
+	if err != nil {
+		return nil, err
+	}
+	podList, err := getPods()
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := getVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ClusterSnapshot{
+		APIVersion:     configAPIVersion,
+		Kind:           snapshotKind,
+		Nodes:          nodeList.Items,
+		NodeMetrics:    []NodeMetrics{},
+		Pods:           []Pod{},
+		Incoming:       []Pod{},
+		ClusterVolumes: *volumes,
+	}
+	for _, n := range nodeList.Items {
+		if n.NodeMetrics.Timestamp != "" {
+			m := n.NodeMetrics
+			m.Metadata = Metadata{Name: n.Metadata.Name}
+			s.NodeMetrics = append(s.NodeMetrics, m)
+		}
+	}
+
+	if cfg.Policies.Enabled {
+		list, err := listSchedulingPolicies()
+		if err != nil {
+			return nil, err
+		}
+		s.SchedulingPolicies = list.Items
+	}
+
+	for _, p := range podList.Items {
+		switch {
+		case p.Spec.NodeName != "":
+			s.Pods = append(s.Pods, p)
+		case cfg.ownsPod(&p):
+			s.Incoming = append(s.Incoming, p)
+		}
+	}
+
+	// The configuration only has YAML tags.
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var config interface{}
+	err = yaml.Unmarshal(b, &config)
+	if err != nil {
+		return nil, err
+	}
+	s.Config = jsonCompatible(config)
+	return s, nil
+}
+
+// anonymize replaces the names of the namespaces, nodes, pods and
+// containers with generated ones, consistently across the snapshot, as well
+// as the names of the persistent volume claims, volumes and policies. Pod labels and
+// annotations are dropped, except the scheduler annotations, and the node
+// labels, pod node selectors and volume node affinities holding a node name
+// are renamed too. The API address, audit sinks and extender address are
+// left out of the configuration.
+func (s *ClusterSnapshot) anonymize() {
+	node := anonymizer("node")
+	namespace := anonymizer("namespace")
+	claim := anonymizer("claim")
+	volume := anonymizer("volume")
+
+	nodeNames := map[string]bool{}
+	for _, n := range s.Nodes {
+		nodeNames[n.Metadata.Name] = true
+	}
+
+	for _, n := range s.Nodes {
+		name := node(n.Metadata.Name)
+		labels := map[string]string{}
+		for k, v := range n.Metadata.Labels {
+			if v == n.Metadata.Name {
+				v = name
+			}
+			labels[k] = v
+		}
+		annotations := map[string]string{}
+		for k, v := range n.Metadata.Annotations {
+			if isSchedulerAnnotation(k) {
+				annotations[k] = v
+			}
+		}
+		n.Metadata = Metadata{Name: name, Labels: labels, Annotations: annotations}
+	}
+	for i := range s.NodeMetrics {
+		s.NodeMetrics[i].Metadata = Metadata{Name: node(s.NodeMetrics[i].Metadata.Name)}
+	}
+
+	count := 0
+	anonymizePods := func(pods []Pod) {
+		for i := range pods {
+			p := &pods[i]
+			count++
+			name := fmt.Sprintf("pod-%d", count)
+
+			annotations := map[string]string{}
+			for k, v := range p.Metadata.Annotations {
+				if isSchedulerAnnotation(k) {
+					annotations[k] = v
+				}
+			}
+			originalNamespace := p.Metadata.Namespace
+			p.Metadata = Metadata{
+				Name:        name,
+				Namespace:   namespace(originalNamespace),
+				Uid:         name,
+				Annotations: annotations,
+			}
+			if p.Spec.NodeName != "" {
+				p.Spec.NodeName = node(p.Spec.NodeName)
+			}
+			// Pods are pinned to a node by its hostname label.
+			for k, v := range p.Spec.NodeSelector {
+				if nodeNames[v] {
+					p.Spec.NodeSelector[k] = node(v)
+				}
+			}
+			for j := range p.Spec.Containers {
+				p.Spec.Containers[j].Name = fmt.Sprintf("container-%d", j+1)
+			}
+			for j := range p.Spec.Volumes {
+				v := &p.Spec.Volumes[j]
+				v.Name = fmt.Sprintf("volume-%d", j+1)
+				if v.PersistentVolumeClaim != nil {
+					v.PersistentVolumeClaim.ClaimName = claim(originalNamespace + "/" + v.PersistentVolumeClaim.ClaimName)
+				}
+			}
+		}
+	}
+	anonymizePods(s.Pods)
+	anonymizePods(s.Incoming)
+
+	for i := range s.Claims {
+		c := &s.Claims[i]
+		c.Metadata = Metadata{
+			Name:      claim(c.Metadata.Namespace + "/" + c.Metadata.Name),
+			Namespace: namespace(c.Metadata.Namespace),
+		}
+		if c.Spec.VolumeName != "" {
+			c.Spec.VolumeName = volume(c.Spec.VolumeName)
+		}
+	}
+	for i := range s.Volumes {
+		v := &s.Volumes[i]
+		v.Metadata = Metadata{Name: volume(v.Metadata.Name)}
+		if ref := v.Spec.ClaimRef; ref != nil {
+			ref.Name = claim(ref.Namespace + "/" + ref.Name)
+			ref.Namespace = namespace(ref.Namespace)
+			ref.Uid = ""
+		}
+		if v.Spec.CSI != nil {
+			v.Spec.CSI.VolumeHandle = v.Metadata.Name
+		}
+		// Local volumes are pinned to their node by name.
+		if v.Spec.NodeAffinity != nil && v.Spec.NodeAffinity.Required != nil {
+			for _, term := range v.Spec.NodeAffinity.Required.NodeSelectorTerms {
+				for _, requirements := range [][]NodeSelectorRequirement{term.MatchExpressions, term.MatchFields} {
+					for _, r := range requirements {
+						for k, value := range r.Values {
+							if nodeNames[value] {
+								r.Values[k] = node(value)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	for i := range s.CSINodes {
+		n := &s.CSINodes[i]
+		n.Metadata = Metadata{Name: node(n.Metadata.Name)}
+		for j := range n.Spec.Drivers {
+			n.Spec.Drivers[j].NodeID = n.Metadata.Name
+		}
+	}
+
+	policy := anonymizer("policy")
+	for i := range s.SchedulingPolicies {
+		p := &s.SchedulingPolicies[i]
+		p.Metadata = Metadata{
+			Name:      policy(policyKey(p.Metadata.Namespace, p.Metadata.Name)),
+			Namespace: namespace(p.Metadata.Namespace),
+		}
+	}
+
+	// The API address, the reloaded ConfigMap, the audit sinks and the
+	// extender address don't matter to the simulations, and may reveal
+	// internal hosts or credentials.
+	if config, ok := s.Config.(map[string]interface{}); ok {
+		delete(config, "api")
+		delete(config, "reload")
+		delete(config, "audit")
+		if e, ok := config["extender"].(map[string]interface{}); ok {
+			delete(e, "bindAddress")
+		}
+		if p, ok := config["policies"].(map[string]interface{}); ok {
+			if key, _ := p["clusterDefault"].(string); key != "" {
+				parts := strings.SplitN(key, "/", 2)
+				p["clusterDefault"] = policyKey(namespace(parts[0]), policy(key))
+			}
+		}
+	}
+}
+
+// anonymizer returns a function giving the same generated name, prefix-N,
+// to each name.
+func anonymizer(prefix string) func(name string) string {
+	names := map[string]string{}
+	return func(name string) string {
+		if _, ok := names[name]; !ok {
+			names[name] = fmt.Sprintf("%s-%d", prefix, len(names)+1)
+		}
+		return names[name]
+	}
+}
+
+// isSchedulerAnnotation tells whether the annotation configures the
+// scheduling of a pod or node.
+func isSchedulerAnnotation(key string) bool {
+	if key == decisionAnnotation {
+		// It names the nodes.
+		return false
+	}
+	return key == "scheduler.alpha.kubernetes.io/name" || strings.HasPrefix(key, schedulerName+"/")
+}
+
+// write encodes the snapshot in YAML or JSON.
+func (s *ClusterSnapshot) write(w io.Writer, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+
+	// Going through JSON keeps the field names of the Kubernetes API.
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	var doc interface{}
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		return err
+	}
+	b, err = yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// snapshotCommand implements the snapshot subcommand: it dumps the state of
+// the cluster, and the configuration, for the simulate subcommand.
+func snapshotCommand(args []string) int {
+	var output, format string
+	var anonymize bool
+	extra := func(fs *flag.FlagSet) {
+		fs.StringVar(&output, "output", "", "Path of the snapshot file, standard output if empty")
+		fs.StringVar(&format, "format", "yaml", "Format of the snapshot: yaml or json")
+		fs.BoolVar(&anonymize, "anonymize", false, "Replace the names of the namespaces, nodes, pods and containers with generated ones")
+	}
+
+	cfg, err := parseConfig(args, extra)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err == nil && cfg == nil {
+		// --print-default-config
+		return 0
+	}
+	if err == nil && format != "yaml" && format != "json" {
+		err = fmt.Errorf("unknown snapshot format %q", format)
+	}
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	apiHost = cfg.API.Host
+	metricsEndpoint = cfg.API.NodeMetricsPath
+
+	start := time.Now()
+	s, err := captureSnapshot(cfg)
+	if err != nil {
+		logger.Error("Failed capturing the cluster state", "err", err)
+		return 1
+	}
+	if anonymize {
+		s.anonymize()
+	}
+
+	w := os.Stdout
+	if output != "" {
+		w, err = os.Create(output)
+		if err != nil {
+			logger.Error("Failed writing the snapshot", "err", err)
+			return 1
+		}
+		defer w.Close()
+	}
+	err = s.write(w, format)
+	if err != nil {
+		logger.Error("Failed writing the snapshot", "err", err)
+		return 1
+	}
+	logger.Info("Captured cluster snapshot", "nodes", len(s.Nodes), "pods", len(s.Pods), "incoming", len(s.Incoming), "duration", time.Since(start))
+	return 0
+}
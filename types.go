@@ -13,26 +13,27 @@
 // limitations under the License.
 package main
 
-// Event is a report of an event somewhere in the cluster.
+// Event is an events.k8s.io/v1 report of an event somewhere in the
+// cluster.
 type Event struct {
-	ApiVersion     string          `json:"apiVersion,omitempty"`
-	Count          int64           `json:"count,omitempty"`
-	FirstTimestamp string          `json:"firstTimestamp"`
-	LastTimestamp  string          `json:"lastTimestamp"`
-	InvolvedObject ObjectReference `json:"involvedObject"`
-	Kind           string          `json:"kind,omitempty"`
-	Message        string          `json:"message,omitempty"`
-	Metadata       Metadata        `json:"metadata"`
-	Reason         string          `json:"reason,omitempty"`
-	Source         EventSource     `json:"source,omitempty"`
-	Type           string          `json:"type,omitempty"`
-	Namespace      string          `json:"-"`
-}
-
-// EventSource contains information for an event.
-type EventSource struct {
-	Component string `json:"component,omitempty"`
-	Host      string `json:"host,omitempty"`
+	ApiVersion          string          `json:"apiVersion"`
+	Kind                string          `json:"kind"`
+	Metadata            Metadata        `json:"metadata"`
+	EventTime           string          `json:"eventTime"`
+	Series              *EventSeries    `json:"series,omitempty"`
+	ReportingController string          `json:"reportingController"`
+	ReportingInstance   string          `json:"reportingInstance"`
+	Action              string          `json:"action"`
+	Reason              string          `json:"reason"`
+	Regarding           ObjectReference `json:"regarding"`
+	Note                string          `json:"note,omitempty"`
+	Type                string          `json:"type"`
+}
+
+// EventSeries counts the occurrences of an event after the first one.
+type EventSeries struct {
+	Count            int32  `json:"count"`
+	LastObservedTime string `json:"lastObservedTime"`
 }
 
 // ObjectReference contains enough information to let you inspect or modify
@@ -59,9 +60,24 @@ type PodWatchEvent struct {
 }
 
 type Pod struct {
-	Kind     string   `json:"kind,omitempty"`
-	Metadata Metadata `json:"metadata"`
-	Spec     PodSpec  `json:"spec"`
+	Kind     string    `json:"kind,omitempty"`
+	Metadata Metadata  `json:"metadata"`
+	Spec     PodSpec   `json:"spec"`
+	Status   PodStatus `json:"status"`
+}
+
+type PodStatus struct {
+	Phase      string         `json:"phase"`
+	Conditions []PodCondition `json:"conditions,omitempty"`
+}
+
+type PodCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastProbeTime      string `json:"lastProbeTime,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
 }
 
 type PodSpec struct {
@@ -69,13 +85,37 @@ type PodSpec struct {
 	Containers    []Container       `json:"containers"`
 	NodeSelector  map[string]string `json:"nodeSelector"`
 	SchedulerName string            `json:"schedulerName"`
+	Volumes       []Volume          `json:"volumes,omitempty"`
+	HostNetwork   bool              `json:"hostNetwork,omitempty"`
+}
+
+// Volume is a volume of a pod. Only the persistent volume claims matter to
+// the scheduling.
+type Volume struct {
+	Name                  string                             `json:"name"`
+	PersistentVolumeClaim *PersistentVolumeClaimVolumeSource `json:"persistentVolumeClaim,omitempty"`
+}
+
+type PersistentVolumeClaimVolumeSource struct {
+	ClaimName string `json:"claimName"`
 }
 
 type Container struct {
 	Name      string               `json:"name"`
+	Ports     []ContainerPort      `json:"ports,omitempty"`
 	Resources ResourceRequirements `json:"resources"`
 }
 
+// ContainerPort is a port exposed by a container. Only the ports with a
+// HostPort are exposed on the node.
+type ContainerPort struct {
+	Name          string `json:"name,omitempty"`
+	HostPort      int32  `json:"hostPort,omitempty"`
+	ContainerPort int32  `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+	HostIP        string `json:"hostIP,omitempty"`
+}
+
 type ResourceRequirements struct {
 	Limits   ResourceList `json:"limits"`
 	Requests ResourceList `json:"requests"`
@@ -104,10 +144,16 @@ type NodeList struct {
 
 type Node struct {
 	Metadata    Metadata    `json:"metadata"`
+	Spec        NodeSpec    `json:"spec"`
 	Status      NodeStatus  `json:"status"`
 	NodeMetrics NodeMetrics `json:"-"`
 }
 
+type NodeSpec struct {
+	// Unschedulable is set on cordoned nodes.
+	Unschedulable bool `json:"unschedulable,omitempty"`
+}
+
 type Condition struct {
 	Type   string `json:"type"`
 	Status string `json:"status"`
@@ -131,6 +177,15 @@ type Metadata struct {
 	Annotations     map[string]string `json:"annotations"`
 	Uid             string            `json:"uid"`
 	Namespace       string            `json:"namespace"`
+	OwnerReferences []OwnerReference  `json:"ownerReferences,omitempty"`
+}
+
+type OwnerReference struct {
+	ApiVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Uid        string `json:"uid"`
+	Controller *bool  `json:"controller,omitempty"`
 }
 
 type Usage struct {
@@ -143,3 +198,172 @@ type NodeMetrics struct {
 	Timestamp string   `json:"timestamp"`
 	Usage     Usage    `json:"usage"`
 }
+
+// PodMetrics is the usage of the containers of a pod, from the
+// metrics.k8s.io API.
+type PodMetrics struct {
+	Metadata   Metadata           `json:"metadata"`
+	Timestamp  string             `json:"timestamp"`
+	Containers []ContainerMetrics `json:"containers"`
+}
+
+type ContainerMetrics struct {
+	Name  string `json:"name"`
+	Usage Usage  `json:"usage"`
+}
+
+type PodMetricsList struct {
+	Items []PodMetrics `json:"items"`
+}
+
+// Job is a batch/v1 Job, only its owner is of interest.
+type Job struct {
+	Metadata Metadata `json:"metadata"`
+}
+
+// Lease is a coordination.k8s.io/v1 Lease, used for leader election.
+type Lease struct {
+	ApiVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Metadata   Metadata  `json:"metadata"`
+	Spec       LeaseSpec `json:"spec"`
+}
+
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+type PersistentVolumeClaimList struct {
+	Items []PersistentVolumeClaim `json:"items"`
+}
+
+type PersistentVolumeClaim struct {
+	Metadata Metadata                    `json:"metadata"`
+	Spec     PersistentVolumeClaimSpec   `json:"spec"`
+	Status   PersistentVolumeClaimStatus `json:"status,omitempty"`
+}
+
+type PersistentVolumeClaimSpec struct {
+	StorageClassName *string              `json:"storageClassName,omitempty"`
+	AccessModes      []string             `json:"accessModes,omitempty"`
+	Resources        ResourceRequirements `json:"resources,omitempty"`
+	// VolumeName is the PersistentVolume the claim is bound to.
+	VolumeName string `json:"volumeName,omitempty"`
+}
+
+type PersistentVolumeClaimStatus struct {
+	Phase string `json:"phase,omitempty"`
+}
+
+type PersistentVolumeList struct {
+	Items []PersistentVolume `json:"items"`
+}
+
+type PersistentVolume struct {
+	Metadata Metadata               `json:"metadata"`
+	Spec     PersistentVolumeSpec   `json:"spec"`
+	Status   PersistentVolumeStatus `json:"status,omitempty"`
+}
+
+type PersistentVolumeSpec struct {
+	StorageClassName string                     `json:"storageClassName,omitempty"`
+	Capacity         ResourceList               `json:"capacity,omitempty"`
+	AccessModes      []string                   `json:"accessModes,omitempty"`
+	ClaimRef         *ObjectReference           `json:"claimRef,omitempty"`
+	NodeAffinity     *VolumeNodeAffinity        `json:"nodeAffinity,omitempty"`
+	CSI              *CSIPersistentVolumeSource `json:"csi,omitempty"`
+}
+
+type PersistentVolumeStatus struct {
+	Phase string `json:"phase,omitempty"`
+}
+
+// VolumeNodeAffinity restricts the nodes a volume can be used from.
+type VolumeNodeAffinity struct {
+	Required *NodeSelector `json:"required,omitempty"`
+}
+
+// NodeSelector matches the nodes matching any of its terms.
+type NodeSelector struct {
+	NodeSelectorTerms []NodeSelectorTerm `json:"nodeSelectorTerms"`
+}
+
+// NodeSelectorTerm matches the nodes matching all its requirements.
+type NodeSelectorTerm struct {
+	MatchExpressions []NodeSelectorRequirement `json:"matchExpressions,omitempty"`
+	MatchFields      []NodeSelectorRequirement `json:"matchFields,omitempty"`
+}
+
+type NodeSelectorRequirement struct {
+	Key      string   `json:"key"`
+	Operator string   `json:"operator"`
+	Values   []string `json:"values,omitempty"`
+}
+
+type CSIPersistentVolumeSource struct {
+	Driver       string `json:"driver"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+type StorageClassList struct {
+	Items []StorageClass `json:"items"`
+}
+
+type StorageClass struct {
+	Metadata          Metadata               `json:"metadata"`
+	Provisioner       string                 `json:"provisioner"`
+	VolumeBindingMode string                 `json:"volumeBindingMode,omitempty"`
+	AllowedTopologies []TopologySelectorTerm `json:"allowedTopologies,omitempty"`
+}
+
+// TopologySelectorTerm matches the nodes with all its label requirements.
+type TopologySelectorTerm struct {
+	MatchLabelExpressions []TopologySelectorLabelRequirement `json:"matchLabelExpressions,omitempty"`
+}
+
+type TopologySelectorLabelRequirement struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+type CSINodeList struct {
+	Items []CSINode `json:"items"`
+}
+
+// CSINode holds the CSI drivers installed on the node of the same name.
+type CSINode struct {
+	Metadata Metadata    `json:"metadata"`
+	Spec     CSINodeSpec `json:"spec"`
+}
+
+type CSINodeSpec struct {
+	Drivers []CSINodeDriver `json:"drivers"`
+}
+
+type CSINodeDriver struct {
+	Name        string               `json:"name"`
+	NodeID      string               `json:"nodeID"`
+	Allocatable *VolumeNodeResources `json:"allocatable,omitempty"`
+}
+
+// VolumeNodeResources holds the number of volumes of a driver which can be
+// attached to the node, unlimited when Count is nil.
+type VolumeNodeResources struct {
+	Count *int32 `json:"count,omitempty"`
+}
+
+type ConfigMap struct {
+	ApiVersion string            `json:"apiVersion,omitempty"`
+	Kind       string            `json:"kind,omitempty"`
+	Metadata   Metadata          `json:"metadata"`
+	Data       map[string]string `json:"data"`
+}
+
+type ConfigMapWatchEvent struct {
+	Type   string    `json:"type"`
+	Object ConfigMap `json:"object"`
+}
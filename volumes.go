@@ -0,0 +1,444 @@
+// Copyright 2020 Ettore Di Giacinto
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	// selectedNodeAnnotation tells the external provisioners which node a
+	// WaitForFirstConsumer claim has to be provisioned for.
+	selectedNodeAnnotation = "volume.kubernetes.io/selected-node"
+
+	// noProvisioner is the provisioner of the storage classes of the
+	// pre-provisioned volumes, local volumes typically.
+	noProvisioner = "kubernetes.io/no-provisioner"
+)
+
+func init() {
+	filterPlugins["VolumeBinding"] = func(*Config) FilterPlugin { return volumeBinding{} }
+	filterPlugins["NodeVolumeLimits"] = func(*Config) FilterPlugin { return nodeVolumeLimits{} }
+}
+
+// ClusterVolumes are the storage objects of the cluster the scheduling of
+// pods with persistent volume claims depends on.
+type ClusterVolumes struct {
+	Claims   []PersistentVolumeClaim `json:"persistentVolumeClaims,omitempty"`
+	Volumes  []PersistentVolume      `json:"persistentVolumes,omitempty"`
+	Classes  []StorageClass          `json:"storageClasses,omitempty"`
+	CSINodes []CSINode               `json:"csiNodes,omitempty"`
+}
+
+// VolumeState indexes the storage objects of the cluster by name. It is
+// shared by the NodeInfos of a scheduling attempt, and never modified.
+type VolumeState struct {
+	claims   map[string]*PersistentVolumeClaim
+	volumes  map[string]*PersistentVolume
+	classes  map[string]*StorageClass
+	csiNodes map[string]*CSINode
+}
+
+func newVolumeState(v *ClusterVolumes) *VolumeState {
+	s := &VolumeState{
+		claims:   map[string]*PersistentVolumeClaim{},
+		volumes:  map[string]*PersistentVolume{},
+		classes:  map[string]*StorageClass{},
+		csiNodes: map[string]*CSINode{},
+	}
+	for i := range v.Claims {
+		c := &v.Claims[i]
+		s.claims[c.Metadata.Namespace+"/"+c.Metadata.Name] = c
+	}
+	for i := range v.Volumes {
+		s.volumes[v.Volumes[i].Metadata.Name] = &v.Volumes[i]
+	}
+	for i := range v.Classes {
+		s.classes[v.Classes[i].Metadata.Name] = &v.Classes[i]
+	}
+	for i := range v.CSINodes {
+		s.csiNodes[v.CSINodes[i].Metadata.Name] = &v.CSINodes[i]
+	}
+	return s
+}
+
+// podVolume is a persistent volume claim of a pod, with the volume it is
+// bound to, or nil, and its storage class, or nil.
+type podVolume struct {
+	claim  *PersistentVolumeClaim
+	volume *PersistentVolume
+	class  *StorageClass
+}
+
+// delayed tells whether the claim is unbound, waiting for its first pod to
+// be scheduled to be bound.
+func (v podVolume) delayed() bool {
+	return v.volume == nil && v.class != nil && v.class.VolumeBindingMode == "WaitForFirstConsumer"
+}
+
+// preProvisioned tells whether the claim is to be bound to one of the
+// existing volumes of its storage class, rather than to a new one.
+func (v podVolume) preProvisioned() bool {
+	return v.delayed() && v.class.Provisioner == noProvisioner
+}
+
+// matchVolumes returns the volumes the pre-provisioned claims among the pod
+// volumes would be bound to on the node, by claim, and false when one of
+// them has none. A claim takes the volume already reserved for it, else the
+// smallest available volume of its storage class large enough, with its
+// access modes and usable from the node.
+func (s *VolumeState) matchVolumes(volumes []podVolume, node *Node) (map[*PersistentVolumeClaim]*PersistentVolume, bool) {
+	matched := map[*PersistentVolumeClaim]*PersistentVolume{}
+	taken := map[string]bool{}
+	for _, v := range volumes {
+		if !v.preProvisioned() {
+			continue
+		}
+		requested, err := memoryBytes(v.claim.Spec.Resources.Requests["storage"])
+		if err != nil {
+			requested = 0
+		}
+
+		var best *PersistentVolume
+		var bestSize int64
+		for _, pv := range s.volumes {
+			if pv.Spec.StorageClassName != v.class.Metadata.Name || taken[pv.Metadata.Name] {
+				continue
+			}
+			affinity := pv.Spec.NodeAffinity
+			if affinity != nil && affinity.Required != nil && !matchNodeSelector(affinity.Required, node) {
+				continue
+			}
+			if reservedFor(pv, v.claim) {
+				best = pv
+				break
+			}
+			if pv.Spec.ClaimRef != nil || (pv.Status.Phase != "" && pv.Status.Phase != "Available") {
+				continue
+			}
+			size, err := memoryBytes(pv.Spec.Capacity["storage"])
+			if err != nil || size < requested || !containsAll(pv.Spec.AccessModes, v.claim.Spec.AccessModes) {
+				continue
+			}
+			if best == nil || size < bestSize || (size == bestSize && pv.Metadata.Name < best.Metadata.Name) {
+				best, bestSize = pv, size
+			}
+		}
+		if best == nil {
+			return nil, false
+		}
+		matched[v.claim] = best
+		taken[best.Metadata.Name] = true
+	}
+	return matched, true
+}
+
+// reservedFor tells whether the volume is reserved for the claim.
+func reservedFor(pv *PersistentVolume, claim *PersistentVolumeClaim) bool {
+	ref := pv.Spec.ClaimRef
+	return ref != nil && ref.Namespace == claim.Metadata.Namespace && ref.Name == claim.Metadata.Name &&
+		(ref.Uid == "" || claim.Metadata.Uid == "" || ref.Uid == claim.Metadata.Uid)
+}
+
+func containsAll(values, wanted []string) bool {
+	for _, w := range wanted {
+		if !contains(values, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// reserve returns a copy of the state with the volumes reserved for their
+// claim, as done by claimVolume, until the next refresh lists them so.
+func (s *VolumeState) reserve(matched map[*PersistentVolumeClaim]*PersistentVolume) *VolumeState {
+	reserved := *s
+	reserved.volumes = make(map[string]*PersistentVolume, len(s.volumes))
+	for name, pv := range s.volumes {
+		reserved.volumes[name] = pv
+	}
+	for claim, pv := range matched {
+		if reservedFor(pv, claim) {
+			continue
+		}
+		copied := *pv
+		copied.Spec.ClaimRef = &ObjectReference{ApiVersion: "v1", Kind: "PersistentVolumeClaim", Namespace: claim.Metadata.Namespace, Name: claim.Metadata.Name, Uid: claim.Metadata.Uid}
+		reserved.volumes[pv.Metadata.Name] = &copied
+	}
+	return &reserved
+}
+
+// podVolumes returns the persistent volume claims of the pod. It fails when
+// a claim, or the volume it is bound to, doesn't exist.
+func (s *VolumeState) podVolumes(pod *Pod) ([]podVolume, error) {
+	volumes := []podVolume{}
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+
+		claim := s.claims[pod.Metadata.Namespace+"/"+v.PersistentVolumeClaim.ClaimName]
+		if claim == nil {
+			return nil, fmt.Errorf("persistentvolumeclaim %q not found", v.PersistentVolumeClaim.ClaimName)
+		}
+
+		pv := podVolume{claim: claim}
+		if claim.Spec.StorageClassName != nil {
+			pv.class = s.classes[*claim.Spec.StorageClassName]
+		}
+		if claim.Spec.VolumeName != "" {
+			pv.volume = s.volumes[claim.Spec.VolumeName]
+			if pv.volume == nil {
+				return nil, fmt.Errorf("persistentvolume %q not found", claim.Spec.VolumeName)
+			}
+		}
+		volumes = append(volumes, pv)
+	}
+	return volumes, nil
+}
+
+// csiVolumes returns the CSI volumes of the pod, by driver and volume
+// handle, with their driver. The WaitForFirstConsumer claims count as the
+// volume their storage class will provision. Missing claims are left out.
+func (s *VolumeState) csiVolumes(pod *Pod) map[string]string {
+	volumes := map[string]string{}
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		claim := s.claims[pod.Metadata.Namespace+"/"+v.PersistentVolumeClaim.ClaimName]
+		if claim == nil {
+			continue
+		}
+
+		if claim.Spec.VolumeName != "" {
+			if pv := s.volumes[claim.Spec.VolumeName]; pv != nil && pv.Spec.CSI != nil {
+				volumes[pv.Spec.CSI.Driver+"/"+pv.Spec.CSI.VolumeHandle] = pv.Spec.CSI.Driver
+			}
+			continue
+		}
+		if claim.Spec.StorageClassName == nil {
+			continue
+		}
+		if class := s.classes[*claim.Spec.StorageClassName]; class != nil && class.VolumeBindingMode == "WaitForFirstConsumer" {
+			volumes[class.Provisioner+"/claim/"+claim.Metadata.Namespace+"/"+claim.Metadata.Name] = class.Provisioner
+		}
+	}
+	return volumes
+}
+
+// volumeBinding rejects the nodes the persistent volumes of the pod can't be
+// used from: the bound volumes must have a node affinity matching the node,
+// the WaitForFirstConsumer claims a storage class which can provision
+// volumes in the topology of the node, or, for the pre-provisioned ones, an
+// available volume usable from the node. Unbound claims in the Immediate
+// binding mode are waited for.
+type volumeBinding struct{}
+
+func (volumeBinding) Name() string { return "VolumeBinding" }
+
+func (volumeBinding) Filter(pod *Pod, node *NodeInfo) error {
+	volumes, err := node.Volumes.podVolumes(pod)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range volumes {
+		switch {
+		case v.volume != nil:
+			affinity := v.volume.Spec.NodeAffinity
+			if affinity != nil && affinity.Required != nil && !matchNodeSelector(affinity.Required, node.Node) {
+				return errors.New("node(s) had volume node affinity conflict")
+			}
+		case !v.delayed():
+			return errors.New("pod has unbound immediate PersistentVolumeClaims")
+		case v.preProvisioned():
+			// Matched below, all together.
+		case !matchTopology(v.class.AllowedTopologies, node.Node):
+			return errors.New("node(s) didn't match the storage class allowed topologies")
+		}
+	}
+	if _, ok := node.Volumes.matchVolumes(volumes, node.Node); !ok {
+		return errors.New("node(s) didn't find available persistent volumes to bind")
+	}
+	return nil
+}
+
+// nodeVolumeLimits rejects the nodes where the CSI volumes of the pod would
+// exceed the number of volumes their driver can attach, as reported by the
+// CSINode of the node.
+type nodeVolumeLimits struct{}
+
+func (nodeVolumeLimits) Name() string { return "NodeVolumeLimits" }
+
+func (nodeVolumeLimits) Filter(pod *Pod, node *NodeInfo) error {
+	csiNode := node.Volumes.csiNodes[node.Name()]
+	if csiNode == nil {
+		return nil
+	}
+	limits := map[string]int{}
+	for _, d := range csiNode.Spec.Drivers {
+		if d.Allocatable != nil && d.Allocatable.Count != nil {
+			limits[d.Name] = int(*d.Allocatable.Count)
+		}
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+
+	// Volumes shared by several pods are attached once.
+	attached := map[string]string{}
+	for _, p := range node.Pods {
+		for handle, driver := range node.Volumes.csiVolumes(p) {
+			attached[handle] = driver
+		}
+	}
+	counts := map[string]int{}
+	for _, driver := range attached {
+		counts[driver]++
+	}
+
+	added := map[string]bool{}
+	for handle, driver := range node.Volumes.csiVolumes(pod) {
+		if _, ok := attached[handle]; !ok {
+			counts[driver]++
+			added[driver] = true
+		}
+	}
+	for driver := range added {
+		if limit, ok := limits[driver]; ok && counts[driver] > limit {
+			return errors.New("node(s) exceed max volume count")
+		}
+	}
+	return nil
+}
+
+// matchNodeSelector tells whether the node matches any of the terms of the
+// selector.
+func matchNodeSelector(selector *NodeSelector, node *Node) bool {
+	fields := map[string]string{"metadata.name": node.Metadata.Name}
+	for _, term := range selector.NodeSelectorTerms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			// An empty term matches no node.
+			continue
+		}
+		if matchRequirements(term.MatchExpressions, node.Metadata.Labels) && matchRequirements(term.MatchFields, fields) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRequirements tells whether the labels match all the requirements.
+func matchRequirements(requirements []NodeSelectorRequirement, labels map[string]string) bool {
+	for _, r := range requirements {
+		value, ok := labels[r.Key]
+		switch r.Operator {
+		case "In":
+			if !ok || !contains(r.Values, value) {
+				return false
+			}
+		case "NotIn":
+			if ok && contains(r.Values, value) {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		case "Gt", "Lt":
+			if !ok || len(r.Values) != 1 {
+				return false
+			}
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return false
+			}
+			bound, err := strconv.ParseInt(r.Values[0], 10, 64)
+			if err != nil {
+				return false
+			}
+			if (r.Operator == "Gt" && v <= bound) || (r.Operator == "Lt" && v >= bound) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// matchTopology tells whether the node labels match any of the terms, or
+// there are no terms.
+func matchTopology(terms []TopologySelectorTerm, node *Node) bool {
+	if len(terms) == 0 {
+		return true
+	}
+TERMS:
+	for _, term := range terms {
+		for _, r := range term.MatchLabelExpressions {
+			value, ok := node.Metadata.Labels[r.Key]
+			if !ok || !contains(r.Values, value) {
+				continue TERMS
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// bindVolumes selects the node for the WaitForFirstConsumer claims of the
+// pod, so that their volumes get provisioned there once the pod is bound.
+// The pre-provisioned claims are reserved the volume they match on the node
+// instead, for the PV controller to bind them.
+func bindVolumes(log *Logger, pod *Pod, node *NodeInfo) error {
+	volumes, err := node.Volumes.podVolumes(pod)
+	if err != nil {
+		return err
+	}
+
+	matched, ok := node.Volumes.matchVolumes(volumes, node.Node)
+	if !ok {
+		return fmt.Errorf("no available persistent volumes to bind on node %s", node.Name())
+	}
+	for claim, pv := range matched {
+		if reservedFor(pv, claim) {
+			continue
+		}
+		err := claimVolume(pv, claim)
+		if err != nil {
+			return fmt.Errorf("reserving volume %s for claim %s: %s", pv.Metadata.Name, claim.Metadata.Name, err.Error())
+		}
+		log.Debug("Reserved the volume of claim", "claim", claim.Metadata.Name, "volume", pv.Metadata.Name)
+	}
+	cache.reserveVolumes(matched)
+
+	for _, v := range volumes {
+		if !v.delayed() || v.preProvisioned() || v.claim.Metadata.Annotations[selectedNodeAnnotation] == node.Name() {
+			continue
+		}
+		err := annotateClaim(v.claim, selectedNodeAnnotation, node.Name())
+		if err != nil {
+			return fmt.Errorf("selecting the node of claim %s: %s", v.claim.Metadata.Name, err.Error())
+		}
+		log.Debug("Selected the node of claim", "claim", v.claim.Metadata.Name, "node", node.Name())
+	}
+	return nil
+}